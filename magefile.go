@@ -1,28 +1,145 @@
+//go:build mage
 // +build mage
 
 // This is a magefile, and is a "makefile for go".
 // See https://magefile.org/
+//
+// The targets are configured with these environment variables, which use the
+// defaults in the const block below when they aren't set.
+//
+// Tools
+//
+//	PORTER_VERBOSE=true                Echo each command and its output, the same as mage -v
+//	PORTER_TOOLS_DIR                   Install the tools from a directory of pre-downloaded binaries, e.g. behind a firewall
+//	PORTER_KIND_VERSION                Version of kind to install
+//	PORTER_KUBECTL_VERSION             Version of kubectl to install, or stable for the latest release
+//	PORTER_FLUX_VERSION                Version of the flux CLI and controllers to install
+//
+// Operator image
+//
+//	PORTER_IMAGE_REPOSITORY            Repository that Build and Publish use instead of the local registry, run docker login first
+//	PORTER_IMAGE_TAG, VERSION          Tag of the operator image, which defaults to the git version
+//	PORTER_MULTIARCH_REPOSITORY        Repository that BuildMultiArch pushes to, which defaults to PORTER_IMAGE_REPOSITORY
+//	PORTER_RELEASE_REPOSITORY          Repository that Release pushes to, e.g. ghcr.io/getporter/porter-operator
+//	PORTER_IMAGE                       Image that AnalyzeImage reports on, instead of the operator image
+//	PORTER_LAYER_WARN_MB               Layer size, in megabytes, that AnalyzeImage warns about
+//	PORTER_IMAGES_ARCHIVE              Archive that SaveImages writes and LoadImages reads, with the image IDs next to it
+//
+// Cluster
+//
+//	PORTER_KIND_CLUSTER                Name of the KIND cluster
+//	PORTER_K8S_VERSION                 Kubernetes minor version of the KIND nodes, e.g. 1.19
+//	PORTER_KIND_WORKERS                Number of worker nodes, in addition to the control plane
+//	PORTER_KEEP_CLUSTER=true           Keep a cluster created with other versions of kind or Kubernetes, instead of recreating it
+//	PORTER_USE_EXISTING_CLUSTER=true   Use the cluster in KUBECONFIG, such as minikube, instead of kind
+//	PORTER_ALLOW_NONKIND=true          Allow the targets to change a cluster other than the project's kind cluster
+//	PORTER_KIND_AUDIT=true             Write the api server audit log to audit-logs, with the policy in hack/audit-policy.yaml
+//	PORTER_KIND_SYSTEM_RESERVED        Resources reserved for the system on each node, e.g. memory=512Mi on a 7GB CI runner
+//	PORTER_KIND_KUBE_RESERVED          Resources reserved for Kubernetes on each node, e.g. memory=512Mi
+//	PORTER_KIND_EVICTION_HARD          When the kubelet evicts pods, e.g. memory.available<256Mi
+//	PORTER_KIND_MOUNTS                 Comma separated HOST_PATH:CONTAINER_PATH directories to mount into the nodes
+//	PORTER_KIND_CNI=calico             Install Calico instead of kindnet, e.g. to test that NetworkPolicies are enforced
+//	PORTER_STOP_REGISTRY=true          Stop the local registry in DeleteKindCluster as well
+//
+// Local registry
+//
+//	PORTER_REGISTRY_PORT               Host port of the local registry
+//	PORTER_REGISTRY_MIRROR             URL of a Docker Hub mirror that the nodes pull from, to avoid rate limits
+//	PORTER_REGISTRY_TLS=true           Serve the registry over https, recreate the cluster after changing it
+//	PORTER_REGISTRY_AUTH=true          Require a username and password, and create the porter-registry pull secret
+//	PORTER_REGISTRY_USERNAME           Username of the registry when PORTER_REGISTRY_AUTH=true
+//	PORTER_REGISTRY_PASSWORD           Password of the registry when PORTER_REGISTRY_AUTH=true
+//	PORTER_GC_KEEP_TAGS                Number of tags that RegistryGC keeps in each repository, deleting the older ones
+//
+// Operator
+//
+//	PORTER_OPERATOR_NAMESPACE          Namespace of the operator, the CRDs and cluster roles are shared with other instances
+//	PORTER_ENABLE_WEBHOOKS=true        Install cert-manager in Deploy, which issues the certificates for the webhooks
+//	PORTER_DRY_RUN=true                Print the manifests that Deploy would apply, and validate them with a server-side dry run
+//	PORTER_GENERATE_CHECK=true         Fail GenerateCRDs and GenerateInstallYAML when the committed files are out of date
+//	PORTER_WATCH_IGNORE                Comma separated file name patterns that don't trigger Watch, *_test.go by default
+//	PORTER_LOGS_SINCE                  How far back Logs starts, e.g. 10m
+//	PORTER_LOGS_PREVIOUS=true          Show the logs of the previous, crashed, container in Logs
+//	PORTER_METRICS_PORT                Local port of the metrics endpoint in PortForward and ScrapeMetrics
+//	PORTER_HEALTH_PORT                 Local port of the health probe endpoint in PortForward
+//	PORTER_SCRAPE_INTERVAL             Amount of time between each scrape in ScrapeMetrics
+//	PORTER_SCRAPE_DURATION             Amount of time that ScrapeMetrics runs, unless it is stopped with Ctrl+C
+//
+// Flux
+//
+//	PORTER_FLUX_COMPONENTS             Comma separated flux controllers to install
+//	PORTER_GITOPS_REPO                 URL of the git repository that BootstrapFlux points flux at
+//	PORTER_GITOPS_BRANCH               Branch of the BootstrapFlux repository, main by default
+//	PORTER_GITOPS_PATH                 Directory of the manifests in the BootstrapFlux repository
+//	PORTER_FLUX_SOURCE                 GitRepository that FluxReconcile syncs, instead of the one created by BootstrapFlux
+//	PORTER_FLUX_KUSTOMIZATION          Kustomization that FluxReconcile syncs, instead of the one created by BootstrapFlux
+//
+// Tests
+//
+//	PKG, RUN                           Packages, e.g. ./controllers/..., and tests, e.g. TestReconcile, that TestUnit runs
+//	COUNT                              Passed to go test -count by TestUnit, and how many times Bench runs each benchmark
+//	PORTER_JUNIT=true                  Run TestUnit with gotestsum, which writes a JUnit report to test-results
+//	PORTER_TEST_RACE=true              Run TestRace as part of Test
+//	PORTER_BENCH_BASELINE              Benchmark results that Bench compares to with benchstat
+//	PORTER_BENCH_THRESHOLD             Percent that a benchmark can slow down before Bench fails
+//	GINKGO_FOCUS, GINKGO_SKIP          Regular expressions of the ginkgo specs to run, or skip, by name
+//	GINKGO_LABELS                      Label filter of the ginkgo specs to run, e.g. "GitOps && !Slow"
+//	GINKGO_NODES                       Number of ginkgo processes that run the specs in parallel
+//	PORTER_UPGRADE_FROM                Release that TestUpgrade upgrades from, which defaults to the latest release tag
+//	SCALE_COUNT, SCALE_TIMEOUT         Number of resources that TestScale creates, and how long it waits for them
+//	SCALE_REPO                         Git repository of the resources that TestScale creates
+//	GROUP, VERSION, KIND               API type that ScaffoldAPI creates, e.g. GROUP=porter VERSION=v1alpha1 KIND=Installation
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"text/template"
+	"time"
 
 	"github.com/carolynvs/magex/mgx"
 	"github.com/carolynvs/magex/pkg"
 	"github.com/carolynvs/magex/shx"
+	"github.com/carolynvs/magex/xplat"
+	"github.com/fsnotify/fsnotify"
 	"github.com/magefile/mage/mg"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"sigs.k8s.io/yaml"
 )
 
 // Default target to run when none is specified
@@ -30,300 +147,4638 @@ import (
 // var Default = Build
 
 const (
-	// Version of KIND to install if not already present
+	// Version of KIND to install if not already present, override with PORTER_KIND_VERSION
 	kindVersion = "v0.10.0"
 
-	// Name of the KIND cluster used for testing
+	// Version of the flux CLI and controllers to install, override with PORTER_FLUX_VERSION
+	fluxVersion = "v0.7.0"
+
+	// Flux controllers that the operator integrates with, override with PORTER_FLUX_COMPONENTS
+	fluxComponents = "source-controller,kustomize-controller,helm-controller"
+
+	// Name of the flux GitRepository and Kustomization created by BootstrapFlux
+	gitopsName = "porter-gitops"
+
+	// Version of kubectl to install if not already present, override with PORTER_KUBECTL_VERSION
+	kubectlVersion = "v1.20.2"
+
+	// Version of kustomize to install if not already present
+	kustomizeVersion = "v3.8.7"
+
+	// Version of helm to install if not already present
+	helmVersion = "v3.5.2"
+
+	// Name of the KIND cluster used for testing, override with PORTER_KIND_CLUSTER
 	kindClusterName = "porter"
 
+	// ConfigMap in kube-public that records the versions used to create the test cluster
+	clusterInfoConfigMap = "porter-cluster-info"
+
 	// Namespace where you can do manual testing
 	testNamespace = "test"
 
-	// Relative location of the KUBECONFIG for the test cluster
+	// API group of the operator's custom resources
+	porterAPIGroup = "porter.sh"
+
+	// Label selector for the jobs and pods that the operator creates to run porter
+	porterJobSelector = "porter.sh/managed=true"
+
+	// Relative location of the KUBECONFIG for the test cluster. Other clusters,
+	// such as the one used by TestE2E, use kind-CLUSTER.config instead.
 	kubeconfig = "kind.config"
 
-	// Namespace of the porter operator
+	// Namespace of the porter operator, override with PORTER_OPERATOR_NAMESPACE
 	operatorNamespace = "porter-operator-system"
 
+	// CNI that kind installs by default, override with PORTER_KIND_CNI
+	defaultKindCNI = "kindnet"
+
+	// Version of Calico to install when PORTER_KIND_CNI=calico
+	calicoVersion = "v3.18.1"
+
+	// Pod network of the cluster when PORTER_KIND_CNI=calico, which is the Calico default
+	calicoPodSubnet = "192.168.0.0/16"
+
+	// Name of the docker network that kind creates for its clusters by default
+	defaultKindNetwork = "kind"
+
 	// Container name of the local registry
 	registryContainer = "registry"
+
+	// Host port of the local registry, override with PORTER_REGISTRY_PORT
+	registryPort = "5000"
+
+	// Docker volume where the local registry stores images
+	registryVolume = "porter-registry-data"
+
+	// Name of the porter operator deployment
+	operatorDeployment = "porter-operator-controller-manager"
+
+	// Namespace where flux is installed
+	fluxNamespace = "flux-system"
+
+	// Columns of the events listed by FluxEvents when the flux CLI doesn't have flux events
+	fluxEventColumns = "custom-columns=LAST_SEEN:.lastTimestamp,NAMESPACE:.metadata.namespace,TYPE:.type,REASON:.reason,KIND:.involvedObject.kind,NAME:.involvedObject.name,SOURCE:.source.component,MESSAGE:.message"
+
+	// Label selector for the CRDs that flux installs
+	fluxCRDSelector = "app.kubernetes.io/part-of=flux"
+
+	// Version of operator-sdk to install if not already present
+	operatorSDKVersion = "v1.3.0"
+
+	// Version of controller-gen to install if not already present
+	controllerGenVersion = "v0.4.1"
+
+	// Version of cert-manager to install when webhooks are enabled
+	certManagerVersion = "v1.1.0"
+
+	// Namespace where cert-manager is installed
+	certManagerNamespace = "cert-manager"
+
+	// Version of porter to install if not already present
+	porterVersion = "v0.33.0"
+
+	// Directory of the bundle published by the Bundle target
+	testBundleDir = "testdata/bundle"
+
+	// Version of kubeconform to install if not already present
+	kubeconformVersion = "v0.4.2"
+
+	// Version of staticcheck to install if not already present
+	staticcheckVersion = "v0.1.2"
+
+	// Version of gotestsum to install if not already present
+	gotestsumVersion = "v1.6.4"
+
+	// Amount of time to wait for the operator to be available after it is deployed
+	deployTimeout = 120 * time.Second
+
+	// Directory of the CRDs generated from the API types
+	crdBasesDir = "config/crd/bases"
+
+	// Amount of time to wait for the CRDs to be established after they are applied
+	crdEstablishedTimeout = 60 * time.Second
+
+	// Amount of time to wait for the operator resources to be deleted before removing their finalizers
+	undeployTimeout = 60 * time.Second
+
+	// Directory containing the ginkgo integration test suites
+	integrationTestsDir = "./test/integration"
+
+	// Directory containing the ginkgo end-to-end test suites
+	e2eTestsDir = "./test/e2e"
+
+	// Name of the dedicated KIND cluster created by TestE2E
+	e2eClusterName = "porter-e2e"
+
+	// Directory where the api server audit log is written when PORTER_KIND_AUDIT=true
+	auditLogsDir = "audit-logs"
+
+	// Directory where Release writes the release artifacts
+	releaseDir = "release"
+
+	// Directory where DumpClusterState saves the state of the cluster
+	debugLogsDir = "debug-logs"
+
+	// Directory where test reports are written
+	testResultsDir = "test-results"
+
+	// File where Bench writes the benchmark results
+	benchOutput = "bench.out"
+
+	// Benchmark results that Bench compares to, override with PORTER_BENCH_BASELINE
+	benchBaseline = "bench-baseline.out"
+
+	// Percent that a benchmark can slow down before Bench fails, override with PORTER_BENCH_THRESHOLD
+	defaultBenchThreshold = "10"
+
+	// Version of ginkgo to install if not already present
+	ginkgoVersion = "v2.1.4"
+
+	// Address where delve listens for a debugger to attach
+	delveAddress = ":2345"
+
+	// Default local port forwarded to the operator metrics endpoint
+	defaultMetricsPort = "8080"
+
+	// Default local port forwarded to the operator health probe endpoint
+	defaultHealthPort = "8081"
+
+	// Default amount of time that ScrapeMetrics collects the operator metrics, override with PORTER_SCRAPE_DURATION
+	defaultScrapeDuration = 5 * time.Minute
+
+	// Default amount of time between each scrape of the operator metrics, override with PORTER_SCRAPE_INTERVAL
+	defaultScrapeInterval = 15 * time.Second
+
+	// Amount of time to wait for the local registry to accept requests after it is started
+	registryReadyTimeout = 30 * time.Second
+
+	// Archive of the operator and flux images saved by SaveImages, override with PORTER_IMAGES_ARCHIVE
+	imagesArchive = "bin/images.tar"
+
+	// Default username and password of the local registry when PORTER_REGISTRY_AUTH=true
+	defaultRegistryUsername = "porter"
+	defaultRegistryPassword = "porter-registry"
+
+	// Directory where the local registry htpasswd file is generated when PORTER_REGISTRY_AUTH=true
+	registryAuthDir = "bin/registry-auth"
+
+	// Name of the image pull secret for the local registry when PORTER_REGISTRY_AUTH=true
+	registryPullSecret = "porter-registry"
+
+	// Directory where the local registry certificate is generated when PORTER_REGISTRY_TLS=true
+	registryCertsDir = "bin/registry-certs"
+
+	// Directory in the kind nodes where the local registry certificates are mounted
+	nodeRegistryCertsDir = "/etc/porter/registry-certs"
+
+	// Name of the porter operator image
+	operatorImageName = "porter-operator"
+
+	// Install manifest generated from config/default by GenerateInstallYAML
+	installYAML = "installation.yaml"
+
+	// Image name in config/manager that is replaced with the operator image when deploying
+	operatorImagePlaceholder = "source-watcher"
+
+	// Platforms included in the multi-arch operator image
+	operatorPlatforms = "linux/amd64,linux/arm64"
+
+	// Name of the docker buildx builder used to build multi-arch images
+	buildxBuilder = "porter-builder"
+
+	// Layers larger than this, in megabytes, are flagged by AnalyzeImage
+	defaultLayerWarningMB = 50
+
+	// Name of the GitRepository created by Smoke
+	smokeName = "porter-smoke"
+
+	// Git repository referenced by the GitRepository created by Smoke and TestUpgrade
+	smokeRepository = "https://github.com/stefanprodan/podinfo"
+
+	// Name of the KIND cluster used by TestUpgrade
+	upgradeClusterName = "porter-upgrade"
+
+	// Name of the GitRepository created by TestUpgrade
+	upgradeRepositoryName = "porter-upgrade"
+
+	// URL of the install manifest uploaded with each release, see Release
+	releaseManifestURL = "https://github.com/getporter/flux/releases/download/%s/porter-operator.yaml"
+
+	// Amount of time that Smoke waits for the operator to reconcile its GitRepository
+	smokeTimeout = 2 * time.Minute
+
+	// Namespace where TestScale creates its resources
+	scaleNamespace = "scale"
+
+	// Default number of resources created by TestScale
+	defaultScaleCount = 1000
+
+	// Default git repository referenced by the resources created by TestScale
+	defaultScaleRepository = "https://github.com/stefanprodan/podinfo"
+
+	// Default amount of time that TestScale waits for the resources to be reconciled
+	defaultScaleTimeout = 10 * time.Minute
 )
 
+// Node images published with the pinned version of KIND, by Kubernetes minor version.
+// Select one with PORTER_K8S_VERSION, otherwise KIND picks its default image.
+// https://github.com/kubernetes-sigs/kind/releases/tag/v0.10.0
+var kindNodeImages = map[string]string{
+	"1.20": "kindest/node:v1.20.2@sha256:8f7ea6e7642c0da54f04a7ee10431549c0257315b3a634f6ef2fecaaedb19bab",
+	"1.19": "kindest/node:v1.19.7@sha256:a70639454e97a4b733f9d9b67e12c01f6b0297449d5b9cbbef87473458e26dca",
+	"1.18": "kindest/node:v1.18.15@sha256:5c1b980c4d0e0e8e7eb9f36f7df525d079a96169c8a8f20d8bd108c0d0889cc4",
+	"1.17": "kindest/node:v1.17.17@sha256:7b6369d27eee99c7a85c48ffd60e11412dc3f373658bc59b7f4d530b7056823e",
+	"1.16": "kindest/node:v1.16.15@sha256:c10a63a5bda231c0a379bf91aebf8ad3c79146daca59db816fb963f731852a99",
+	"1.15": "kindest/node:v1.15.12@sha256:67181f94f0b3072fb56509107b380e38c55e23bf60e6f052fbd8052d26052fb5",
+	"1.14": "kindest/node:v1.14.10@sha256:3fbed72bcac108055e46e7b4091eb6858ad628ec51bf693c21f5ec34578f6180",
+}
+
+// Platforms, as GOOS/GOARCH, published by each tool that we download. The
+// release assets use the same architecture names as Go, so a platform that
+// isn't listed, and has no fallback, is unsupported.
+var toolPlatforms = map[string][]string{
+	"kind":         {"linux/amd64", "linux/arm64", "linux/ppc64le", "darwin/amd64", "windows/amd64"},
+	"kubectl":      {"linux/amd64", "linux/arm64", "linux/arm", "linux/386", "darwin/amd64", "darwin/arm64", "windows/amd64", "windows/386"},
+	"operator-sdk": {"linux/amd64", "linux/arm64", "linux/ppc64le", "linux/s390x", "darwin/amd64"},
+	"flux":         {"linux/amd64", "linux/arm64", "linux/arm", "darwin/amd64", "windows/amd64"},
+	"kustomize":    {"linux/amd64", "linux/arm64", "darwin/amd64", "windows/amd64"},
+	"kubeconform":  {"linux/amd64", "linux/arm64", "darwin/amd64"},
+	"porter":       {"linux/amd64", "darwin/amd64", "windows/amd64"},
+	"helm":         {"linux/amd64", "linux/arm64", "linux/arm", "linux/386", "linux/ppc64le", "linux/s390x", "darwin/amd64", "windows/amd64"},
+}
+
+// Platforms that can run the release for another platform, when a tool
+// doesn't publish one for them.
+var toolPlatformFallbacks = map[string]string{
+	// Apple Silicon can run amd64 binaries with Rosetta
+	"darwin/arm64": "darwin/amd64",
+}
+
+// Client used to download tools and query registries. It uses the proxy
+// configured with HTTP_PROXY, HTTPS_PROXY and NO_PROXY. There is no overall
+// timeout because some of the downloads are large, instead connections that
+// stall before responding time out.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// Hosts that the local registry certificate is valid for, the registry
+// container name is how the kind nodes connect to it
+var registryHosts = []string{"localhost", "127.0.0.1", registryContainer}
+
+// Matches a semver release tag, e.g. v1.2.3 or v1.2.3-beta.1
+var semverTag = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// Matches a Kubernetes API version, e.g. v1 or v1alpha1
+var apiVersionPattern = regexp.MustCompile(`^v[1-9][0-9]*((alpha|beta)[1-9][0-9]*)?$`)
+
+// Matches a Kubernetes kind, e.g. Installation
+var apiKindPattern = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+
 // Build a command that stops the build on if the command fails
 var must = shx.CommandBuilder{StopOnError: true}
 
+// Loggers for each part of the build, so that it's clear what a message is about
+var (
+	buildLog    stepLogger = "build"
+	fluxLog     stepLogger = "flux"
+	kindLog     stepLogger = "kind"
+	operatorLog stepLogger = "operator"
+	registryLog stepLogger = "registry"
+	testLog     stepLogger = "test"
+	toolsLog    stepLogger = "tools"
+	watchLog    stepLogger = "watch"
+)
+
+func init() {
+	// Echo each command and its output when PORTER_VERBOSE=true, the same as mage -v
+	if verbose, _ := strconv.ParseBool(os.Getenv("PORTER_VERBOSE")); verbose {
+		os.Setenv(mg.VerboseEnv, "1")
+	}
+}
+
+// stepLogger prints messages prefixed with the part of the build that they
+// are about, e.g. [kind].
+type stepLogger string
+
+// Printf prints a high-level step, which is always shown.
+func (l stepLogger) Printf(format string, args ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	fmt.Printf("[%s] %s\n", l, msg)
+}
+
+// Debugf prints details that are only shown with PORTER_VERBOSE=true or mage -v.
+func (l stepLogger) Debugf(format string, args ...interface{}) {
+	if mg.Verbose() {
+		l.Printf(format, args...)
+	}
+}
+
 // Ensure mage is installed.
 func EnsureMage() error {
 	addGopathBinOnGithubActions()
 	return pkg.EnsureMage("v1.11.0")
 }
 
+// Install all of the tools used for development, in parallel.
+func EnsureTools() {
+	// Update the PATH before the tools are installed concurrently, so that
+	// they don't race to modify it
+	mgx.Must(pkg.EnsureGopathBin())
+	mgx.Must(addGopathBinOnGithubActions())
+
+	mg.Deps(EnsureKind, EnsureKubectl, EnsureKustomize, EnsureFlux, EnsureControllerGen, EnsureGinkgo, EnsureYq)
+}
+
+// Only add GOPATH/bin to GITHUB_PATH once, no matter how many targets need it
+var addGopathBinOnce sync.Once
+var addGopathBinErr error
+
 // Add GOPATH/bin to the path on the GitHub Actions agent
 // TODO: Add to magex
 func addGopathBinOnGithubActions() error {
+	addGopathBinOnce.Do(func() {
+		addGopathBinErr = appendGopathBinToGithubPath()
+	})
+	return addGopathBinErr
+}
+
+func appendGopathBinToGithubPath() error {
 	githubPath := os.Getenv("GITHUB_PATH")
 	if githubPath == "" {
 		return nil
 	}
 
-	log.Println("Adding GOPATH/bin to the PATH for the GitHub Actions Agent")
+	toolsLog.Debugf("Adding GOPATH/bin to the PATH for the GitHub Actions Agent")
 	gopathBin := pkg.GetGopathBin()
-	return ioutil.WriteFile(githubPath, []byte(gopathBin), 0644)
+
+	// Each line appended to GITHUB_PATH is added to the PATH, so don't overwrite what's already there
+	f, err := os.OpenFile(githubPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", githubPath)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(gopathBin + "\n")
+	return errors.Wrapf(err, "error writing to %s", githubPath)
 }
 
+// Generate deepcopy code, RBAC, webhook and CRD manifests.
 func Generate() {
+	mg.Deps(EnsureControllerGen)
+
 	must.RunV("controller-gen", `object:headerFile="hack/boilerplate.go.txt"`, `paths="./..."`)
+	must.RunV("controller-gen", "rbac:roleName=source-reader", "webhook", `paths="./..."`)
+	mg.Deps(GenerateCRDs)
 }
 
-func Fmt() {
-	must.RunV("go", "fmt", "./...")
-}
+// Scaffold the API type set by GROUP, VERSION and KIND, and its controller, with operator-sdk.
+func ScaffoldAPI() {
+	mg.Deps(EnsureOperatorSDK)
 
-func Vet() {
-	must.RunV("go", "vet", "./...")
-}
+	const usage = "usage: GROUP=porter VERSION=v1alpha1 KIND=Installation mage ScaffoldAPI"
+	group, version, kind := os.Getenv("GROUP"), os.Getenv("VERSION"), os.Getenv("KIND")
+	if group == "" || version == "" || kind == "" {
+		mgx.Must(errors.Errorf("GROUP, VERSION and KIND must be set\n%s", usage))
+	}
+	if !apiVersionPattern.MatchString(version) {
+		mgx.Must(errors.Errorf("invalid VERSION %q, expected a Kubernetes API version such as v1, v1alpha1 or v2beta1\n%s", version, usage))
+	}
+	if !apiKindPattern.MatchString(kind) {
+		mgx.Must(errors.Errorf("invalid KIND %q, expected a CamelCase name such as Installation\n%s", kind, usage))
+	}
 
-// Run all tests
-func Test() {
-	mg.Deps(TestUnit)
+	must.RunV("operator-sdk", "create", "api", "--group", group, "--version", version, "--kind", kind,
+		"--resource", "--controller")
+	mg.Deps(Generate)
 }
 
-// Run unit tests.
-func TestUnit() {
-	must.RunV("go", "test", "./...", "-coverprofile", "coverage-unit.out")
-}
+// Verify that the generated code and manifests are up-to-date.
+func Verify() {
+	generatedPaths := []string{"api", "config"}
 
-// Ensure operator-sdk is installed.
-func EnsureOperatorSDK() {
-	const version = "v1.3.0"
+	before := getUncommittedChanges(generatedPaths...)
+	mg.Deps(Generate)
+	after := getUncommittedChanges(generatedPaths...)
 
-	if runtime.GOOS == "windows" {
-		mgx.Must(errors.New("Sorry, OperatorSDK does not support Windows. In order to contribute to this repository, you will need to use WSL."))
+	var stale []string
+	for file, status := range after {
+		if before[file] != status {
+			stale = append(stale, file)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	sort.Strings(stale)
+
+	must.Command("git", append([]string{"--no-pager", "diff", "--"}, stale...)...).RunV()
+
+	// Restore the stale files, unless they already had uncommitted changes
+	for _, file := range stale {
+		if _, dirty := before[file]; dirty {
+			continue
+		}
+		if after[file] == "??" {
+			os.RemoveAll(file)
+		} else {
+			shx.RunE("git", "checkout", "--", file)
+		}
 	}
 
-	url := "https://github.com/operator-framework/operator-sdk/releases/{{.VERSION}}/download/operator-sdk_{{.GOOS}}_{{.GOARCH}}"
-	mgx.Must(pkg.DownloadToGopathBin(url, "operator-sdk", version))
+	mgx.Must(errors.Errorf("generated files are out of date, run `mage Generate` and commit the changes:\n%s", strings.Join(stale, "\n")))
 }
 
-// Ensure that the test KIND cluster is up.
-func EnsureCluster() {
-	mg.Deps(EnsureKubectl)
+// getUncommittedChanges returns the git status of each changed file under the specified paths.
+func getUncommittedChanges(paths ...string) map[string]string {
+	out, err := shx.OutputE("git", append([]string{"status", "--porcelain", "--untracked-files=all", "--"}, paths...)...)
+	mgx.Must(errors.Wrap(err, "could not get the git status"))
 
-	if !useCluster() {
-		CreateKindCluster()
+	changes := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 4 {
+			continue
+		}
+		changes[line[3:]] = strings.TrimSpace(line[:2])
 	}
-	configureCluster()
+	return changes
 }
 
-// get the config of the current kind cluster, if available
-func getClusterConfig() (kubeconfig string, ok bool) {
-	contents, err := shx.OutputE("kind", "get", "kubeconfig", "--name", kindClusterName)
-	return contents, err == nil
-}
+// Generate the CRD manifests from the API types.
+func GenerateCRDs() {
+	mg.Deps(EnsureControllerGen)
 
-// setup environment to use the current kind cluster, if available
-func useCluster() bool {
-	contents, ok := getClusterConfig()
-	if ok {
-		log.Println("Reusing existing kind cluster")
+	must.RunV("controller-gen", "crd:crdVersions=v1,trivialVersions=false,preserveUnknownFields=false", `paths="./..."`,
+		"output:crd:artifacts:config="+crdBasesDir)
 
-		userKubeConfig, _ := filepath.Abs(os.Getenv("KUBECONFIG"))
-		currentKubeConfig := filepath.Join(pwd(), kubeconfig)
-		if userKubeConfig != currentKubeConfig {
-			fmt.Printf("ATTENTION! You should set your KUBECONFIG to match the cluster used by this project\n\n\texport KUBECONFIG=%s\n\n", currentKubeConfig)
+	if check, _ := strconv.ParseBool(os.Getenv("PORTER_GENERATE_CHECK")); check {
+		changes, err := shx.OutputE("git", "status", "--porcelain", "--", crdBasesDir)
+		mgx.Must(errors.Wrapf(err, "could not check %s for changes", crdBasesDir))
+		if changes != "" {
+			mgx.Must(errors.Errorf("the CRDs are out of date with the API types, run `mage GenerateCRDs` and commit the changes:\n%s", changes))
 		}
-		os.Setenv("KUBECONFIG", currentKubeConfig)
+	}
+}
 
-		err := ioutil.WriteFile(kubeconfig, []byte(contents), 0644)
-		mgx.Must(errors.Wrapf(err, "error writing %s", kubeconfig))
+// Build the operator container image.
+func Build() {
+	mg.Deps(Generate)
 
-		setClusterNamespace(operatorNamespace)
-		return true
+	img := getOperatorImage()
+	buildLog.Printf("Building %s", img)
+	must.RunV("docker", "build", "-t", img, ".")
+}
+
+// Build the operator image for multiple architectures and push it.
+func BuildMultiArch() {
+	mg.Deps(Generate)
+
+	repository := getEnvOrDefault("PORTER_MULTIARCH_REPOSITORY", getOperatorImageRepository())
+	if isLocalRepository(repository) {
+		mg.Deps(StartDockerRegistry)
 	}
+	ensureBuildxBuilder()
 
-	return false
+	// Multi-platform images can't be loaded into the local docker image store,
+	// so the image is pushed as part of the build
+	img := repository + ":" + getOperatorImageTag()
+	buildLog.Printf("Building and pushing %s for %s", img, operatorPlatforms)
+	must.RunV("docker", "buildx", "build", "--builder", buildxBuilder, "--platform", operatorPlatforms,
+		"-t", img, "--push", ".")
 }
 
-func setClusterNamespace(name string) {
-	must.RunE("kubectl", "config", "set-context", "--current", "--namespace", name)
+// ensureBuildxBuilder creates the buildx builder for multi-arch builds if it doesn't exist.
+func ensureBuildxBuilder() {
+	if err := shx.RunS("docker", "buildx", "inspect", buildxBuilder); err == nil {
+		return
+	}
+
+	// Use the host network so that the builder can push to the local registry on localhost
+	buildLog.Printf("Creating the %s buildx builder", buildxBuilder)
+	must.RunE("docker", "buildx", "create", "--name", buildxBuilder, "--driver", "docker-container",
+		"--driver-opt", "network=host")
 }
 
-// Create a KIND cluster named porter.
-func CreateKindCluster() {
-	mg.Deps(EnsureKind)
+// Release the operator image and install manifest from the current git tag, e.g. v1.2.3.
+func Release() {
+	mg.Deps(EnsureKustomize)
 
-	// Determine host ip to populate kind config api server details
-	// https://kind.sigs.k8s.io/docs/user/configuration/#api-server
-	addrs, err := net.InterfaceAddrs()
-	mgx.Must(errors.Wrap(err, "could not get a list of network interfaces"))
-
-	var ipAddress string
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				fmt.Println("Current IP address : ", ipnet.IP.String())
-				ipAddress = ipnet.IP.String()
-				break
-			}
-		}
+	if changes, err := shx.OutputS("git", "status", "--porcelain"); err != nil || changes != "" {
+		mgx.Must(errors.Errorf("refusing to release because the tree has uncommitted changes:\n%s", changes))
 	}
 
-	os.Setenv("KUBECONFIG", filepath.Join(pwd(), kubeconfig))
-	kindCfg, err := ioutil.ReadFile("hack/kind.config.yaml")
-	mgx.Must(errors.Wrap(err, "error reading hack/kind.config.yaml"))
-
-	kindCfgTmpl, err := template.New("kind.config.yaml").Parse(string(kindCfg))
-	mgx.Must(errors.Wrap(err, "error parsing Kind config template hack/kind.config.yaml"))
-
-	var kindCfgContents bytes.Buffer
-	kindCfgData := struct {
-		Address string
-	}{
-		Address: ipAddress,
+	tag, err := shx.OutputS("git", "describe", "--tags", "--exact-match")
+	if err != nil {
+		mgx.Must(errors.New("refusing to release because the current commit is not tagged"))
+	}
+	if !semverTag.MatchString(tag) {
+		mgx.Must(errors.Errorf("refusing to release because the tag %s is not a semver version, such as v1.2.3", tag))
 	}
-	err = kindCfgTmpl.Execute(&kindCfgContents, kindCfgData)
-	err = ioutil.WriteFile("kind.config.yaml", kindCfgContents.Bytes(), 0644)
-	mgx.Must(errors.Wrap(err, "could not write kind config file"))
-	defer os.Remove("kind.config.yaml")
 
-	must.Run("kind", "create", "cluster", "--name", kindClusterName, "--config", "kind.config.yaml")
+	repository := os.Getenv("PORTER_RELEASE_REPOSITORY")
+	if repository == "" {
+		mgx.Must(errors.New("PORTER_RELEASE_REPOSITORY must be set to the repository where the operator image is released"))
+	}
 
-	// Connect the kind and registry containers on the same network
-	must.Run("docker", "network", "connect", "kind", registryContainer)
+	os.Setenv("PORTER_IMAGE_TAG", tag)
+	os.Setenv("PORTER_MULTIARCH_REPOSITORY", repository)
+	mg.Deps(BuildMultiArch)
 
-	// Document the local registry
-	kubectl("apply", "-f", "hack/local-registry.yaml").Run()
+	img := repository + ":" + tag
+	mgx.Must(os.MkdirAll(releaseDir, 0755))
+	installManifest := filepath.Join(releaseDir, "porter-operator.yaml")
+	err = ioutil.WriteFile(installManifest, []byte(buildOperatorManifests(img, operatorNamespace)), 0644)
+	mgx.Must(errors.Wrapf(err, "error writing %s", installManifest))
+	buildLog.Printf("Released %s, upload %s with the release", img, installManifest)
 }
 
-func configureCluster() {
-	mg.Deps(StartDockerRegistry)
+// Push the operator image to the local registry.
+func Publish() {
+	mg.Deps(Build)
 
-	setClusterNamespace(operatorNamespace)
+	repository := getOperatorImageRepository()
+	local := isLocalRepository(repository)
+	if local {
+		mg.Deps(StartDockerRegistry)
+	}
 
-	must.RunV("flux", "install")
-}
+	// The image is pushed to localhost:PORT from the host, and the KIND nodes
+	// resolve localhost:PORT to the registry container through the containerd
+	// mirror configured in hack/kind.config.yaml, so Deploy uses the same reference
+	img := getOperatorImage()
+	buildLog.Printf("Pushing %s", img)
+	must.RunV("docker", "push", img)
 
-// Delete the KIND cluster named porter.
-func DeleteKindCluster() {
-	mg.Deps(EnsureKind)
+	if !local {
+		return
+	}
 
-	must.RunE("kind", "delete", "cluster", "--name", kindClusterName)
+	tags, err := getRegistryTags(repository)
+	mgx.Must(errors.Wrapf(err, "could not verify that %s was pushed", img))
 
-	if isOnDockerNetwork(registryContainer, "kind") {
-		must.RunE("docker", "network", "disconnect", "kind", registryContainer)
+	tag := getOperatorImageTag()
+	for _, t := range tags {
+		if t == tag {
+			return
+		}
 	}
+	mgx.Must(errors.Errorf("%s was pushed but the registry does not have the %s tag, found %v", img, tag, tags))
 }
 
-func isOnDockerNetwork(container string, network string) bool {
-	networkId, _ := shx.OutputE("docker", "network", "inspect", network, "-f", "{{.Id}}")
-	networks, _ := shx.OutputE("docker", "inspect", container, "-f", "{{json .NetworkSettings.Networks}}")
-	return strings.Contains(networks, networkId)
-}
-
-// Ensure kind is installed.
-func EnsureKind() {
-	if ok, _ := pkg.IsCommandAvailable("kind", ""); ok {
+// Deploy the operator to the test cluster.
+func Deploy() {
+	if dryRun, _ := strconv.ParseBool(os.Getenv("PORTER_DRY_RUN")); dryRun {
+		deployDryRun()
 		return
 	}
 
-	kindURL := "https://github.com/kubernetes-sigs/kind/releases/download/{{.VERSION}}/kind-{{.GOOS}}-{{.GOARCH}}"
-	mgx.Must(pkg.DownloadToGopathBin(kindURL, "kind", kindVersion))
+	mg.Deps(EnsureCluster, Publish, EnsureKustomize)
+	deploy()
 }
 
-// Ensure kubectl is installed.
-func EnsureKubectl() {
-	if ok, _ := pkg.IsCommandAvailable("kubectl", ""); ok {
-		return
+// deploy the operator to the current cluster, which must already exist.
+// Unlike Deploy, it isn't memoized by mage, so a target that switches to a
+// dedicated cluster can deploy to it after the test cluster was deployed.
+func deploy() {
+	mg.Deps(Publish, EnsureKustomize)
+	mg.Deps(ValidateManifests)
+	if webhooks, _ := strconv.ParseBool(os.Getenv("PORTER_ENABLE_WEBHOOKS")); webhooks {
+		ensureCertManager()
 	}
 
-	versionURL := "https://storage.googleapis.com/kubernetes-release/release/stable.txt"
-	versionResp, err := http.Get(versionURL)
-	mgx.Must(errors.Wrapf(err, "unable to determine the latest version of kubectl"))
+	operatorLog.Printf("Deploying %s to the %s namespace", getOperatorImage(), getOperatorNamespace())
+	manifests := buildOperatorManifests(getOperatorImage(), getOperatorNamespace())
+	kubectl("apply", "-f", "-").Stdin(strings.NewReader(manifests)).Run()
+	mgx.Must(waitForCRDs(crdEstablishedTimeout))
+	if useRegistryAuth() {
+		// The nodes don't have the local registry credentials, so the operator needs a pull secret
+		mgx.Must(createRegistryPullSecret(getOperatorNamespace()))
+		patch := fmt.Sprintf(`{"spec":{"template":{"spec":{"imagePullSecrets":[{"name":%q}]}}}}`, registryPullSecret)
+		kubectl("patch", "deployment", operatorDeployment, "-n", getOperatorNamespace(), "-p", patch).Run()
+	}
 
-	if versionResp.StatusCode > 299 {
-		mgx.Must(errors.Errorf("GET %s (%s): %s", versionURL, versionResp.StatusCode, versionResp.Status))
+	err := waitForDeployment(getOperatorNamespace(), operatorDeployment, deployTimeout)
+	mgx.Must(errors.Wrapf(err, "check its status with `kubectl describe deployment %s -n %s`", operatorDeployment, getOperatorNamespace()))
+}
+
+// deployDryRun prints the manifests that Deploy would apply, and validates
+// them with a server-side dry run, which runs the admission checks without
+// changing the cluster. Nothing is built, pushed or created, not even the
+// cluster, so resources in a namespace that doesn't exist yet are rejected.
+func deployDryRun() {
+	mg.Deps(EnsureKubectl, EnsureKustomize)
+
+	if !useCluster() {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage EnsureCluster`", getClusterName()))
 	}
-	defer versionResp.Body.Close()
 
-	kubectlVersion, err := ioutil.ReadAll(versionResp.Body)
-	mgx.Must(errors.Wrapf(err, "error reading response from %s", versionURL))
+	manifests := buildOperatorManifests(getOperatorImage(), getOperatorNamespace())
+	fmt.Print(manifests)
 
-	kindURL := "https://storage.googleapis.com/kubernetes-release/release/{{.VERSION}}/bin/{{.GOOS}}/{{.GOARCH}}/kubectl{{.EXT}}"
-	mgx.Must(pkg.DownloadToGopathBin(kindURL, "kubectl", string(kubectlVersion)))
+	operatorLog.Printf("Validating the deployment of %s to the %s namespace with a server-side dry run", getOperatorImage(), getOperatorNamespace())
+	kubectl("apply", "--dry-run=server", "-f", "-").Stdin(strings.NewReader(manifests)).RunV()
 }
 
-// Run a makefile target
-func makefile(args ...string) shx.PreparedCommand {
-	cmd := must.Command("make", args...)
-	cmd.Env("KUBECONFIG=" + os.Getenv("KUBECONFIG"))
+// Validate the operator manifests against the Kubernetes schemas and the operator's CRDs.
+func ValidateManifests() {
+	mg.Deps(EnsureKustomize, EnsureKubeconform)
 
-	return cmd
-}
+	manifests := buildOperatorManifests(getOperatorImage(), getOperatorNamespace())
 
-func kubectl(args ...string) shx.PreparedCommand {
-	kubeconfig := fmt.Sprintf("KUBECONFIG=%s", os.Getenv("KUBECONFIG"))
-	return must.Command("kubectl", args...).Env(kubeconfig)
-}
+	schemaDir, err := ioutil.TempDir("", "porter-operator-schemas")
+	mgx.Must(errors.Wrap(err, "could not create a temporary directory"))
+	defer os.RemoveAll(schemaDir)
+	mgx.Must(writeCRDSchemas(crdBasesDir, schemaDir))
 
-func kustomize(args ...string) shx.PreparedCommand {
-	cmd := filepath.Join(pwd(), "bin/kustomize")
-	return must.Command(cmd, args...)
-}
+	args := []string{"-strict", "-summary", "-output", "text",
+		"-schema-location", "default",
+		"-schema-location", filepath.Join(schemaDir, "{{ .ResourceKind }}_{{ .ResourceAPIVersion }}.json")}
+	if version := getServerVersion(); version != "" {
+		args = append(args, "-kubernetes-version", version)
+	}
 
-// Ensure yq is installed.
-func EnsureYq() {
-	mgx.Must(pkg.EnsurePackage("github.com/mikefarah/yq/v4", "", ""))
+	operatorLog.Printf("Validating the operator manifests")
+	must.Command("kubeconform", args...).Stdin(strings.NewReader(manifests)).RunV()
 }
 
-// Ensure ginkgo is installed.
-func EnsureGinkgo() {
-	mgx.Must(pkg.EnsurePackage("github.com/onsi/ginkgo/ginkgo", "", ""))
-}
+// getServerVersion returns the Kubernetes version of the current cluster,
+// e.g. 1.20.2, or an empty string when the cluster isn't reachable.
+func getServerVersion() string {
+	out, err := kubectl("version", "-o", "json", "--request-timeout=5s").Must(false).Output()
+	if err != nil {
+		return ""
+	}
 
-// Ensure kustomize is installed.
-func EnsureKustomize() {
-	// TODO: implement installing from a URL that is tgz
-	makefile("kustomize").Run()
+	var version struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := json.Unmarshal([]byte(out), &version); err != nil {
+		return ""
+	}
+
+	// Remove the v prefix and any build metadata, e.g. v1.20.2+k3s1
+	gitVersion := strings.TrimPrefix(version.ServerVersion.GitVersion, "v")
+	return strings.SplitN(strings.SplitN(gitVersion, "+", 2)[0], "-", 2)[0]
 }
 
-func EnsureFlux() {
-	// TODO
+// writeCRDSchemas converts the schemas in the CRDs in a directory to the
+// JSON schema files used by kubeconform, named KIND_VERSION.json.
+func writeCRDSchemas(crdDir string, schemaDir string) error {
+	crdFiles, err := filepath.Glob(filepath.Join(crdDir, "*.yaml"))
+	if err != nil {
+		return errors.Wrapf(err, "could not list the CRDs in %s", crdDir)
+	}
+
+	for _, crdFile := range crdFiles {
+		contents, err := ioutil.ReadFile(crdFile)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s", crdFile)
+		}
+
+		var crd struct {
+			Spec struct {
+				Names struct {
+					Kind string `json:"kind"`
+				} `json:"names"`
+				Versions []struct {
+					Name   string `json:"name"`
+					Schema struct {
+						OpenAPIV3Schema json.RawMessage `json:"openAPIV3Schema"`
+					} `json:"schema"`
+				} `json:"versions"`
+			} `json:"spec"`
+		}
+		if err := yaml.Unmarshal(contents, &crd); err != nil {
+			return errors.Wrapf(err, "could not parse the CRD %s", crdFile)
+		}
+
+		for _, version := range crd.Spec.Versions {
+			if len(version.Schema.OpenAPIV3Schema) == 0 {
+				continue
+			}
+			schemaFile := filepath.Join(schemaDir, fmt.Sprintf("%s_%s.json", strings.ToLower(crd.Spec.Names.Kind), version.Name))
+			if err := ioutil.WriteFile(schemaFile, version.Schema.OpenAPIV3Schema, 0644); err != nil {
+				return errors.Wrapf(err, "error writing %s", schemaFile)
+			}
+		}
+	}
+	return nil
 }
 
-// Ensure controller-gen is installed.
-func EnsureControllerGen() {
-	mgx.Must(pkg.EnsurePackage("sigs.k8s.io/controller-tools/cmd/controller-gen", "v0.4.1", "--version"))
+// buildOperatorManifests renders the operator manifests in config/default,
+// with the deployment using the specified image, in the specified namespace.
+// These are set in a temporary copy of config, so that the tree isn't modified.
+func buildOperatorManifests(img string, namespace string) string {
+	tmp, err := ioutil.TempDir("", "porter-operator-config")
+	mgx.Must(errors.Wrap(err, "could not create a temporary directory"))
+	defer os.RemoveAll(tmp)
+
+	configDir := filepath.Join(tmp, "config")
+	mgx.Must(copyDir("config", configDir))
+
+	kustomize("edit", "set", "image", operatorImagePlaceholder+"="+img).
+		In(filepath.Join(configDir, "manager")).RunS()
+	kustomize("edit", "set", "namespace", namespace).
+		In(filepath.Join(configDir, "default")).RunS()
+	manifests, err := kustomize("build", filepath.Join(configDir, "default")).Output()
+	mgx.Must(errors.Wrap(err, "could not build the operator manifests"))
+	return manifests
 }
 
-// Ensure that a local docker registry is running.
-func StartDockerRegistry() {
-	if isContainerRunning(registryContainer) {
+// Generate installation.yaml, the manifest that users install the operator with.
+func GenerateInstallYAML() {
+	mg.Deps(EnsureKustomize)
+
+	manifests, err := kustomize("build", "config/default").Output()
+	mgx.Must(errors.Wrap(err, "could not build the operator manifests"))
+	generated, err := normalizeManifests(manifests)
+	mgx.Must(err)
+
+	if check, _ := strconv.ParseBool(os.Getenv("PORTER_GENERATE_CHECK")); !check {
+		mgx.Must(errors.Wrapf(ioutil.WriteFile(installYAML, []byte(generated), 0644), "could not write %s", installYAML))
 		return
 	}
 
-	StopDockerRegistry()
+	committed, err := ioutil.ReadFile(installYAML)
+	if os.IsNotExist(err) {
+		mgx.Must(errors.Errorf("%s does not exist, run `mage GenerateInstallYAML` and commit it", installYAML))
+	}
+	mgx.Must(errors.Wrapf(err, "could not read %s", installYAML))
+	current, err := normalizeManifests(string(committed))
+	mgx.Must(errors.Wrapf(err, "could not parse %s", installYAML))
+	if current == generated {
+		return
+	}
 
-	fmt.Println("Starting local docker registry")
-	must.RunE("docker", "run", "-d", "-p", "5000:5000", "--name", registryContainer, "registry:2")
+	tmp, err := ioutil.TempFile("", "installation*.yaml")
+	mgx.Must(errors.Wrap(err, "could not create a temporary file"))
+	defer os.Remove(tmp.Name())
+	tmp.WriteString(generated)
+	tmp.Close()
+	// git diff exits with 1 when the files are different
+	shx.Command("git", "--no-pager", "diff", "--no-index", "--", installYAML, tmp.Name()).RunV()
+	mgx.Must(errors.Errorf("%s is out of date with config, run `mage GenerateInstallYAML` and commit the changes", installYAML))
 }
 
-// Stops the local docker registry.
-func StopDockerRegistry() {
-	if containerExists(registryContainer) {
-		fmt.Println("Stopping local docker registry")
-		removeContainer(registryContainer)
-	}
+// Order that resources are written to an install manifest, so that
+// resources are created before what depends on them, e.g. namespaces first.
+// Other kinds are written after these, and webhooks are always last.
+var manifestKindOrder = []string{
+	"Namespace", "ResourceQuota", "LimitRange", "PodSecurityPolicy", "PodDisruptionBudget",
+	"ServiceAccount", "Secret", "ConfigMap", "StorageClass", "PersistentVolume",
+	"PersistentVolumeClaim", "CustomResourceDefinition", "ClusterRole", "ClusterRoleBinding",
+	"Role", "RoleBinding", "Service", "DaemonSet", "Pod", "ReplicationController", "ReplicaSet",
+	"Deployment", "HorizontalPodAutoscaler", "StatefulSet", "Job", "CronJob", "Ingress", "APIService",
 }
 
-func isContainerRunning(name string) bool {
-	out, _ := shx.OutputS("docker", "container", "inspect", "-f", "{{.State.Running}}", name)
-	running, _ := strconv.ParseBool(out)
-	return running
+// getManifestKindRank returns where a kind of resource is written in an install manifest.
+func getManifestKindRank(kind string) int {
+	for i, k := range manifestKindOrder {
+		if k == kind {
+			return i
+		}
+	}
+	if strings.HasSuffix(kind, "WebhookConfiguration") {
+		return len(manifestKindOrder) + 1
+	}
+	return len(manifestKindOrder)
 }
 
-func containerExists(name string) bool {
-	err := shx.RunS("docker", "inspect", name)
-	return err == nil
+// normalizeManifests sorts a stream of yaml documents by kind, in the order
+// they should be created, then namespace and name, and formats each with sorted fields, so that manifests with the same
+// resources compare equal regardless of ordering and whitespace.
+func normalizeManifests(manifests string) (string, error) {
+	type document struct {
+		rank     int
+		key      string
+		contents []byte
+	}
+
+	var docs []document
+	for _, doc := range regexp.MustCompile(`(?m)^---\s*$`).Split(manifests, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		var resource map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &resource); err != nil {
+			return "", errors.Wrap(err, "invalid yaml document")
+		}
+		if resource == nil {
+			continue
+		}
+		contents, err := yaml.Marshal(resource)
+		if err != nil {
+			return "", errors.Wrap(err, "could not format the yaml document")
+		}
+
+		kind, _ := resource["kind"].(string)
+		metadata, _ := resource["metadata"].(map[string]interface{})
+		key := fmt.Sprintf("%s/%v/%v", kind, metadata["namespace"], metadata["name"])
+		docs = append(docs, document{rank: getManifestKindRank(kind), key: key, contents: contents})
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		if docs[i].rank != docs[j].rank {
+			return docs[i].rank < docs[j].rank
+		}
+		return docs[i].key < docs[j].key
+	})
+
+	var result strings.Builder
+	for i, doc := range docs {
+		if i > 0 {
+			result.WriteString("---\n")
+		}
+		result.Write(doc.contents)
+	}
+	return result.String(), nil
+}
+
+// copyDir recursively copies the files in a directory.
+func copyDir(src string, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s", path)
+		}
+		return errors.Wrapf(ioutil.WriteFile(target, contents, info.Mode()), "could not write %s", target)
+	})
+}
+
+// waitForDeployment waits for a deployment to finish rolling out. When the
+// timeout expires, the returned error includes the status of its pods.
+func waitForDeployment(namespace string, name string, timeout time.Duration) error {
+	err := kubectl("rollout", "status", "deployment/"+name, "-n", namespace, fmt.Sprintf("--timeout=%s", timeout)).
+		Must(false).RunE()
+	if err == nil {
+		return nil
+	}
+
+	pods := "no pods found"
+	if selector, err := getDeploymentSelector(namespace, name); err == nil {
+		if out, err := kubectl("get", "pods", "-n", namespace, "-l", selector, "-o", "wide").Must(false).OutputS(); err == nil && out != "" {
+			pods = out
+		}
+	}
+	return errors.Errorf("the %s deployment in the %s namespace was not ready after %s:\n%s", name, namespace, timeout, pods)
+}
+
+// getCRDNames returns the names of the CRDs in a directory, e.g. config/crd/bases.
+func getCRDNames(crdDir string) ([]string, error) {
+	crdFiles, err := filepath.Glob(filepath.Join(crdDir, "*.yaml"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list the CRDs in %s", crdDir)
+	}
+
+	names := make([]string, 0, len(crdFiles))
+	for _, crdFile := range crdFiles {
+		contents, err := ioutil.ReadFile(crdFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read %s", crdFile)
+		}
+
+		var crd struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if err := yaml.Unmarshal(contents, &crd); err != nil {
+			return nil, errors.Wrapf(err, "could not parse the CRD %s", crdFile)
+		}
+		if crd.Metadata.Name != "" {
+			names = append(names, crd.Metadata.Name)
+		}
+	}
+	return names, nil
+}
+
+// waitForCRDs waits for the operator's CRDs to be established, so that the
+// api server accepts custom resources, instead of failing with "no matches
+// for kind", when they are created right after the CRDs are applied.
+func waitForCRDs(timeout time.Duration) error {
+	names, err := getCRDNames(crdBasesDir)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for _, name := range names {
+		err := waitForCondition("", "crd", name, "Established", time.Until(deadline))
+		if err != nil {
+			return errors.Wrapf(err, "check its status with `kubectl describe crd %s`", name)
+		}
+	}
+	return nil
+}
+
+// waitForCondition waits for a condition of a resource, such as the Ready
+// condition of a GitRepository, to be True. Leave the namespace empty for
+// cluster scoped resources. When the timeout expires, the returned error
+// includes the last status and message of the condition.
+func waitForCondition(namespace string, resource string, name string, conditionType string, timeout time.Duration) error {
+	condition := fmt.Sprintf(`.status.conditions[?(@.type==%q)]`, conditionType)
+	args := []string{"get", resource, name, "-o", fmt.Sprintf(`jsonpath={%s.status}{"\t"}{%s.message}`, condition, condition)}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status, message string
+		out, err := kubectl(args...).Must(false).OutputS()
+		if err != nil {
+			message = err.Error()
+		} else {
+			parts := strings.SplitN(out, "\t", 2)
+			status = strings.TrimSpace(parts[0])
+			if len(parts) > 1 {
+				message = strings.TrimSpace(parts[1])
+			}
+		}
+		if status == "True" {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if status == "" {
+				status = "not reported"
+			}
+			target := fmt.Sprintf("%s/%s", resource, name)
+			if namespace != "" {
+				target = fmt.Sprintf("%s in the %s namespace", target, namespace)
+			}
+			return errors.Errorf("the %s condition of %s was not True after %s (status: %s, message: %s)", conditionType, target, timeout, status, message)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// getDeploymentSelector returns the label selector for the pods of a deployment.
+func getDeploymentSelector(namespace string, name string) (string, error) {
+	selector, err := kubectl("get", "deployment", name, "-n", namespace,
+		"-o", `go-template={{range $k, $v := .spec.selector.matchLabels}}{{$k}}={{$v}},{{end}}`).Must(false).OutputE()
+	if err != nil {
+		return "", errors.Wrapf(err, "could not find the %s deployment", name)
+	}
+	return strings.TrimSuffix(selector, ","), nil
+}
+
+// Install cert-manager in the test cluster and wait for it to be ready.
+func EnsureCertManager() {
+	mg.Deps(EnsureCluster)
+	ensureCertManager()
+}
+
+// ensureCertManager installs cert-manager in the current cluster, without
+// being memoized by mage like EnsureCertManager.
+func ensureCertManager() {
+	manifests := fmt.Sprintf("https://github.com/jetstack/cert-manager/releases/download/%s/cert-manager.yaml", certManagerVersion)
+	operatorLog.Printf("Installing cert-manager %s", certManagerVersion)
+	kubectl("apply", "-f", manifests).Run()
+
+	// The webhook must be ready before any certificates can be created
+	for _, deployment := range []string{"cert-manager", "cert-manager-cainjector", "cert-manager-webhook"} {
+		mgx.Must(waitForDeployment(certManagerNamespace, deployment, deployTimeout))
+	}
+}
+
+// Remove the operator from the test cluster, leaving the cluster and flux installed.
+func Undeploy() {
+	mg.Deps(EnsureKubectl, EnsureKustomize)
+
+	if !useCluster() {
+		operatorLog.Printf("The test cluster does not exist, so there is nothing to undeploy")
+		return
+	}
+	requireKindContext()
+
+	operatorLog.Printf("Removing the operator from the %s namespace", getOperatorNamespace())
+	manifests := buildOperatorManifests(getOperatorImage(), getOperatorNamespace())
+	err := kubectl("delete", "-f", "-", "--ignore-not-found", fmt.Sprintf("--timeout=%s", undeployTimeout)).
+		Stdin(strings.NewReader(manifests)).Must(false).RunE()
+	if err == nil {
+		return
+	}
+
+	// Deleting a CRD waits for all of its custom resources to be removed, which
+	// hangs when a finalizer can't complete, e.g. because the operator is gone
+	operatorLog.Printf("Timed out waiting for the operator resources to be deleted, removing finalizers")
+	remaining, _ := kubectl("get", "-f", "-", "-o", "name", "--ignore-not-found").
+		Stdin(strings.NewReader(manifests)).Must(false).OutputS()
+	for _, resource := range strings.Split(remaining, "\n") {
+		if !strings.HasPrefix(resource, "customresourcedefinition") {
+			continue
+		}
+		removeCRDFinalizers(strings.SplitN(resource, "/", 2)[1])
+	}
+
+	kubectl("delete", "-f", "-", "--ignore-not-found", fmt.Sprintf("--timeout=%s", undeployTimeout)).
+		Stdin(strings.NewReader(manifests)).Run()
+}
+
+// removeCRDFinalizers clears the finalizers on a CRD and all of its custom
+// resources, so that they can be deleted.
+func removeCRDFinalizers(crd string) {
+	crs, _ := kubectl("get", crd, "--all-namespaces", "-o", `jsonpath={range .items[*]}{.metadata.namespace} {.metadata.name}{"\n"}{end}`).Must(false).OutputS()
+	for _, cr := range strings.Split(crs, "\n") {
+		fields := strings.Fields(cr)
+		if len(fields) != 2 {
+			continue
+		}
+		removeFinalizers(crd, fields[0], fields[1])
+	}
+	removeFinalizers("crd", "", crd)
+}
+
+// removeFinalizers clears the finalizers on a resource so that it can be deleted.
+func removeFinalizers(resource string, namespace string, name string) {
+	args := []string{"patch", resource, name, "--type=merge", "-p", `{"metadata":{"finalizers":[]}}`}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	kubectl(args...).Must(false).RunE()
+}
+
+// Build the test bundle in testdata/bundle and publish it to the local registry.
+func Bundle() {
+	mg.Deps(EnsurePorter, StartDockerRegistry)
+
+	tag, err := getTestBundleTag()
+	mgx.Must(err)
+	buildLog.Printf("Publishing the %s bundle to %s", testBundleDir, tag)
+	must.Command("porter", "build").In(testBundleDir).RunV()
+	must.Command("porter", "publish", "--tag", tag).In(testBundleDir).RunV()
+}
+
+// getTestBundleTag returns the reference of the test bundle in the local
+// registry, from the name and version in its porter.yaml, so that it is
+// published to the registry port configured with PORTER_REGISTRY_PORT.
+func getTestBundleTag() (string, error) {
+	manifest := filepath.Join(testBundleDir, "porter.yaml")
+	contents, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read %s", manifest)
+	}
+
+	var bundle struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := yaml.Unmarshal(contents, &bundle); err != nil {
+		return "", errors.Wrapf(err, "could not parse %s", manifest)
+	}
+	if bundle.Name == "" || bundle.Version == "" {
+		return "", errors.Errorf("%s must have a name and version", manifest)
+	}
+	return fmt.Sprintf("localhost:%s/%s:v%s", getRegistryPort(), bundle.Name, bundle.Version), nil
+}
+
+// Load the operator image directly into the KIND cluster, without using the local registry.
+func LoadImage() {
+	mg.Deps(EnsureKind, Build)
+
+	if _, ok := getClusterConfig(); !ok {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage CreateKindCluster`", getClusterName()))
+	}
+
+	img := getOperatorImage()
+	kindLog.Printf("Loading %s into the %s cluster", img, getClusterName())
+	must.RunV("kind", "load", "docker-image", img, "--name", getClusterName())
+
+	nodes, err := shx.OutputE("kind", "get", "nodes", "--name", getClusterName())
+	mgx.Must(errors.Wrap(err, "could not list the kind nodes"))
+
+	repository, tag := getOperatorImageRepository(), getOperatorImageTag()
+	for _, node := range strings.Fields(nodes) {
+		images, err := shx.OutputE("docker", "exec", node, "crictl", "images")
+		mgx.Must(errors.Wrapf(err, "could not list the images on %s", node))
+
+		found := false
+		for _, line := range strings.Split(images, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == repository && fields[1] == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			mgx.Must(errors.Errorf("%s was loaded but was not found on node %s", img, node))
+		}
+	}
+}
+
+// Save the operator and flux controller images to bin/images.tar, for CI to cache between runs.
+func SaveImages() {
+	if useExistingCluster() {
+		mgx.Must(errors.New("refusing to save the images because PORTER_USE_EXISTING_CLUSTER is set, it may not be a kind cluster"))
+	}
+	mg.Deps(EnsureKubectl)
+
+	if !useCluster() {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage EnsureCluster`", getClusterName()))
+	}
+
+	images, err := getFluxImages()
+	mgx.Must(err)
+	images = append(images, getOperatorImage())
+
+	var ids strings.Builder
+	for _, img := range images {
+		// The nodes pulled the flux images, so they may not be on the host yet
+		id, err := shx.OutputE("docker", "image", "inspect", "-f", "{{.Id}}", img)
+		if err != nil {
+			kindLog.Printf("Pulling %s", img)
+			must.RunE("docker", "pull", img)
+			id, err = shx.OutputE("docker", "image", "inspect", "-f", "{{.Id}}", img)
+			mgx.Must(errors.Wrapf(err, "could not inspect %s", img))
+		}
+		fmt.Fprintf(&ids, "%s %s\n", img, id)
+	}
+
+	archive := getImagesArchive()
+	mgx.Must(errors.Wrapf(os.MkdirAll(filepath.Dir(archive), 0755), "could not create the directory for %s", archive))
+	kindLog.Printf("Saving %d images to %s", len(images), archive)
+	must.RunE("docker", append([]string{"save", "-o", archive}, images...)...)
+
+	idsFile := strings.TrimSuffix(archive, filepath.Ext(archive)) + ".txt"
+	mgx.Must(errors.Wrapf(ioutil.WriteFile(idsFile, []byte(ids.String()), 0644), "could not write %s", idsFile))
+}
+
+// Load the images saved with SaveImages into the KIND cluster, e.g. mage CreateKindCluster LoadImages EnsureCluster.
+func LoadImages() {
+	mg.Deps(EnsureKind)
+
+	if useExistingCluster() {
+		mgx.Must(errors.New("images can only be loaded into a kind cluster, unset PORTER_USE_EXISTING_CLUSTER"))
+	}
+	if _, ok := getClusterConfig(); !ok {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage CreateKindCluster`", getClusterName()))
+	}
+
+	archive := getImagesArchive()
+	if _, err := os.Stat(archive); os.IsNotExist(err) {
+		kindLog.Printf("%s does not exist, so there are no images to load", archive)
+		return
+	}
+
+	kindLog.Printf("Loading the images from %s into the %s cluster", archive, getClusterName())
+	must.RunE("docker", "load", "-i", archive)
+	must.RunV("kind", "load", "image-archive", archive, "--name", getClusterName())
+}
+
+// getImagesArchive returns the path of the archive used by SaveImages and
+// LoadImages, set with PORTER_IMAGES_ARCHIVE.
+func getImagesArchive() string {
+	return getEnvOrDefault("PORTER_IMAGES_ARCHIVE", imagesArchive)
+}
+
+// getFluxImages returns the images of the flux controllers in the test cluster.
+func getFluxImages() ([]string, error) {
+	out, err := kubectl("get", "deployments", "-n", fluxNamespace,
+		"-o", `jsonpath={range .items[*].spec.template.spec.containers[*]}{.image}{"\n"}{end}`).Must(false).OutputE()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list the flux deployments in the %s namespace", fluxNamespace)
+	}
+
+	images := strings.Fields(out)
+	if len(images) == 0 {
+		return nil, errors.Errorf("flux is not installed in the %s namespace, install it with `mage EnsureCluster`", fluxNamespace)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// Restart the operator pods, without rebuilding or redeploying the operator.
+func RestartOperator() {
+	mg.Deps(EnsureKubectl)
+
+	if !useCluster() || !isOperatorDeployed() {
+		operatorLog.Printf("The operator is not deployed, deploy it with `mage Deploy`")
+		return
+	}
+	requireKindContext()
+
+	operatorLog.Printf("Restarting the %s deployment", operatorDeployment)
+	kubectl("rollout", "restart", "deployment/"+operatorDeployment, "-n", getOperatorNamespace()).Run()
+	mgx.Must(waitForDeployment(getOperatorNamespace(), operatorDeployment, deployTimeout))
+}
+
+// Stream the logs of the operator.
+func Logs() {
+	mg.Deps(EnsureKubectl)
+
+	if !useCluster() || !isOperatorDeployed() {
+		operatorLog.Printf("The operator is not deployed, deploy it with `mage Deploy`")
+		return
+	}
+
+	args := []string{"logs", "deployment/" + operatorDeployment, "-n", getOperatorNamespace(), "-c", "manager"}
+	if since := os.Getenv("PORTER_LOGS_SINCE"); since != "" {
+		args = append(args, "--since", since)
+	}
+	if previous, _ := strconv.ParseBool(os.Getenv("PORTER_LOGS_PREVIOUS")); previous {
+		args = append(args, "--previous")
+		kubectl(args...).RunV()
+		return
+	}
+
+	args = append(args, "--follow")
+	logs := kubectl(args...).Stdout(os.Stdout)
+	mgx.Must(errors.Wrap(runUntilInterrupted(logs), "kubectl logs stopped unexpectedly"))
+}
+
+// Forward the operator metrics and health probe endpoints to localhost.
+func PortForward() {
+	mg.Deps(EnsureKubectl)
+
+	if !useCluster() || !isOperatorDeployed() {
+		operatorLog.Printf("The operator is not deployed, deploy it with `mage Deploy`")
+		return
+	}
+
+	metricsPort := getEnvOrDefault("PORTER_METRICS_PORT", defaultMetricsPort)
+	healthPort := getEnvOrDefault("PORTER_HEALTH_PORT", defaultHealthPort)
+	operatorLog.Printf("Forwarding http://localhost:%s/metrics and http://localhost:%s/healthz, press Ctrl+C to stop", metricsPort, healthPort)
+
+	forward := operatorPortForward(metricsPort+":8080", healthPort+":8081").Stdout(os.Stdout)
+	mgx.Must(errors.Wrap(runUntilInterrupted(forward), "kubectl port-forward stopped unexpectedly"))
+}
+
+// operatorPortForward returns the command that forwards ports, formatted
+// LOCAL:REMOTE, to the operator deployment.
+func operatorPortForward(ports ...string) shx.PreparedCommand {
+	args := append([]string{"port-forward", "deployment/" + operatorDeployment, "-n", getOperatorNamespace()}, ports...)
+	return kubectl(args...)
+}
+
+// Collect the operator metrics over a window of time to debug-logs, and summarize them.
+func ScrapeMetrics() {
+	mg.Deps(EnsureKubectl)
+
+	if !useCluster() || !isOperatorDeployed() {
+		mgx.Must(errors.New("the operator is not deployed, deploy it with `mage Deploy`"))
+	}
+
+	duration, err := getDurationEnv("PORTER_SCRAPE_DURATION", defaultScrapeDuration)
+	mgx.Must(err)
+	interval, err := getDurationEnv("PORTER_SCRAPE_INTERVAL", defaultScrapeInterval)
+	mgx.Must(err)
+
+	ctx, stop := notifyOnInterrupt()
+	defer stop()
+
+	metricsPort := getEnvOrDefault("PORTER_METRICS_PORT", defaultMetricsPort)
+	forwardCtx, stopForward := context.WithCancel(ctx)
+	forwardDone := make(chan error, 1)
+	go func() {
+		forwardDone <- runWithContext(forwardCtx, operatorPortForward(metricsPort+":8080"))
+	}()
+	defer func() {
+		stopForward()
+		<-forwardDone
+	}()
+
+	mgx.Must(os.MkdirAll(debugLogsDir, 0755))
+	file := filepath.Join(debugLogsDir, fmt.Sprintf("metrics-%s.prom", time.Now().Format("20060102-150405")))
+	out, err := os.Create(file)
+	mgx.Must(errors.Wrapf(err, "could not create %s", file))
+	defer out.Close()
+
+	metricsURL := fmt.Sprintf("http://localhost:%s/metrics", metricsPort)
+	operatorLog.Printf("Scraping %s every %s for %s, press Ctrl+C to stop early", metricsURL, interval, duration)
+
+	var first, last metricSamples
+	scrapes := 0
+	start := time.Now()
+	deadline := start.Add(duration)
+	for {
+		body, err := scrapeMetrics(ctx, metricsURL)
+		if err != nil && scrapes == 0 {
+			// The port forward may still be starting up
+			select {
+			case err := <-forwardDone:
+				mgx.Must(errors.Wrap(err, "kubectl port-forward stopped unexpectedly"))
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			if time.Since(start) > 30*time.Second {
+				mgx.Must(errors.Wrapf(err, "could not scrape the operator metrics"))
+			}
+			continue
+		}
+
+		if err != nil {
+			operatorLog.Printf("Could not scrape the operator metrics: %s", err)
+		} else {
+			fmt.Fprintf(out, "# scraped at %s\n%s\n", time.Now().Format(time.RFC3339), body)
+			last = parseMetrics(body)
+			if scrapes == 0 {
+				first = last
+			}
+			scrapes++
+			operatorLog.Debugf("Saved %d samples to %s", len(last), file)
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	operatorLog.Printf("Saved %d scrapes of the operator metrics to %s", scrapes, file)
+	if scrapes < 2 {
+		// With a single scrape, summarize everything since the operator started
+		first = nil
+	}
+	printMetricsSummary(first, last, time.Since(start))
+}
+
+// getDurationEnv returns the duration in an environment variable, or the
+// default when it isn't set.
+func getDurationEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid %s %q, expected a duration such as 30s or 5m", key, value)
+	}
+	return d, nil
+}
+
+// scrapeMetrics returns the metrics from a Prometheus metrics endpoint.
+func scrapeMetrics(ctx context.Context, metricsURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, metricsURL, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid url %s", metricsURL)
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "GET %s", metricsURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return "", errors.Errorf("GET %s: %s", metricsURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), errors.Wrapf(err, "error reading the response from %s", metricsURL)
+}
+
+// metricSample is a single sample in the Prometheus text format, e.g.
+// controller_runtime_reconcile_total{controller="gitrepository",result="success"} 12
+type metricSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// metricLabelPattern matches a label in a Prometheus sample, e.g. result="success".
+var metricLabelPattern = regexp.MustCompile(`(\w+)="((?:[^"\\]|\\.)*)"`)
+
+// metricSamples are the samples scraped from a Prometheus metrics endpoint.
+type metricSamples []metricSample
+
+// sum adds up the values of every sample of the named metric, across all labels.
+func (m metricSamples) sum(name string) float64 {
+	var total float64
+	for _, sample := range m {
+		if sample.name == name {
+			total += sample.value
+		}
+	}
+	return total
+}
+
+// parseMetrics parses the samples in the Prometheus text format, skipping
+// comments and lines that can't be parsed.
+func parseMetrics(text string) metricSamples {
+	var samples metricSamples
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sample := metricSample{labels: map[string]string{}}
+		series := line
+		if i := strings.Index(line, "{"); i >= 0 {
+			j := strings.LastIndex(line, "}")
+			if j < i {
+				continue
+			}
+			sample.name = line[:i]
+			for _, match := range metricLabelPattern.FindAllStringSubmatch(line[i+1:j], -1) {
+				sample.labels[match[1]] = match[2]
+			}
+			series = sample.name + line[j+1:]
+		}
+
+		fields := strings.Fields(series)
+		if len(fields) < 2 {
+			continue
+		}
+		if sample.name == "" {
+			sample.name = fields[0]
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		sample.value = value
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// controllerMetrics summarizes the controller-runtime metrics of a controller
+// over the window that ScrapeMetrics collected.
+type controllerMetrics struct {
+	results    map[string]float64
+	latencySum float64
+	latency    map[float64]float64
+	queueDepth float64
+}
+
+// printMetricsSummary prints the reconciles of each controller between the
+// first and last scrape, with their mean and 95th percentile latency, and
+// the queue depth when the scraping stopped. When first is empty, the
+// totals since the operator started are printed instead.
+func printMetricsSummary(first []metricSample, last []metricSample, window time.Duration) {
+	if len(last) == 0 {
+		fmt.Println("No metrics were collected")
+		return
+	}
+
+	controllers := map[string]*controllerMetrics{}
+	getController := func(name string) *controllerMetrics {
+		if c, ok := controllers[name]; ok {
+			return c
+		}
+		c := &controllerMetrics{results: map[string]float64{}, latency: map[float64]float64{}}
+		controllers[name] = c
+		return c
+	}
+
+	// Counters and histograms are cumulative, so subtract the first scrape to
+	// get the values for the window
+	apply := func(samples []metricSample, sign float64) {
+		for _, sample := range samples {
+			switch sample.name {
+			case "controller_runtime_reconcile_total":
+				getController(sample.labels["controller"]).results[sample.labels["result"]] += sign * sample.value
+			case "controller_runtime_reconcile_time_seconds_sum":
+				getController(sample.labels["controller"]).latencySum += sign * sample.value
+			case "controller_runtime_reconcile_time_seconds_bucket":
+				le, err := strconv.ParseFloat(sample.labels["le"], 64)
+				if err == nil {
+					getController(sample.labels["controller"]).latency[le] += sign * sample.value
+				}
+			case "workqueue_depth":
+				if sign > 0 {
+					getController(sample.labels["name"]).queueDepth = sample.value
+				}
+			}
+		}
+	}
+	apply(last, 1)
+	apply(first, -1)
+
+	names := make([]string, 0, len(controllers))
+	for name := range controllers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Reconciles over %s:\n", window.Round(time.Second))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTROLLER\tSUCCESS\tREQUEUE\tERROR\tMEAN LATENCY\tP95 LATENCY\tQUEUE DEPTH")
+	for _, name := range names {
+		c := controllers[name]
+		total := c.results["success"] + c.results["requeue"] + c.results["requeue_after"] + c.results["error"]
+		mean, p95 := "-", "-"
+		if total > 0 {
+			mean = fmt.Sprintf("%.3fs", c.latencySum/total)
+			p95 = getHistogramQuantile(c.latency, 0.95)
+		}
+		fmt.Fprintf(w, "%s\t%.0f\t%.0f\t%.0f\t%s\t%s\t%.0f\n", name, c.results["success"],
+			c.results["requeue"]+c.results["requeue_after"], c.results["error"], mean, p95, c.queueDepth)
+	}
+	w.Flush()
+}
+
+// getHistogramQuantile returns the upper bound of the histogram bucket that
+// contains a quantile, e.g. "<= 0.5s".
+func getHistogramQuantile(buckets map[float64]float64, quantile float64) string {
+	bounds := make([]float64, 0, len(buckets))
+	for le := range buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Float64s(bounds)
+	if len(bounds) == 0 {
+		return "-"
+	}
+
+	// The +Inf bucket counts every observation
+	total := buckets[bounds[len(bounds)-1]]
+	for _, le := range bounds {
+		if total > 0 && buckets[le] >= quantile*total {
+			if math.IsInf(le, 1) && len(bounds) > 1 {
+				return fmt.Sprintf("> %gs", bounds[len(bounds)-2])
+			}
+			return fmt.Sprintf("<= %gs", le)
+		}
+	}
+	return "-"
+}
+
+// Rebuild and redeploy the operator whenever its source code changes.
+func Watch() {
+	mg.Deps(Deploy)
+
+	ignore := strings.Split(getEnvOrDefault("PORTER_WATCH_IGNORE", "*_test.go"), ",")
+
+	watcher, err := fsnotify.NewWatcher()
+	mgx.Must(errors.Wrap(err, "could not create a file watcher"))
+	defer watcher.Close()
+
+	// The repository root is watched for main.go, and the source directories recursively
+	mgx.Must(watcher.Add("."))
+	for _, dir := range []string{"api", "controllers"} {
+		mgx.Must(watchDirectory(watcher, dir))
+	}
+
+	ctx, stop := notifyOnInterrupt()
+	defer stop()
+
+	watchLog.Printf("Watching for changes, press Ctrl+C to stop")
+	baseVersion := getOperatorImageTag()
+	var changed string
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.Errors:
+			watchLog.Printf("error watching files: %s", err)
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					watchDirectory(watcher, event.Name)
+					continue
+				}
+			}
+			if !isWatchedSourceFile(event.Name, ignore) {
+				continue
+			}
+			// Wait for changes to settle, editors often write several times when saving
+			changed = event.Name
+			debounce.Reset(time.Second)
+		case <-debounce.C:
+			watchLog.Printf("%s changed, redeploying", changed)
+			start := time.Now()
+			// Use a unique tag each time so that the deployment pulls the new image
+			os.Setenv("PORTER_IMAGE_TAG", fmt.Sprintf("%s-%d", baseVersion, start.Unix()))
+			if err := redeployOperator(); err != nil {
+				watchLog.Printf("redeploy failed: %s", err)
+			} else {
+				watchLog.Printf("deployed %s in %s", getOperatorImage(), time.Since(start).Round(time.Second))
+			}
+		}
+	}
+}
+
+// watchDirectory adds a directory and its subdirectories to the watcher.
+func watchDirectory(watcher *fsnotify.Watcher, dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		return watcher.Add(path)
+	})
+}
+
+// isWatchedSourceFile determines if a changed file should trigger a redeploy.
+func isWatchedSourceFile(file string, ignore []string) bool {
+	file = filepath.Clean(file)
+	if filepath.Ext(file) != ".go" {
+		return false
+	}
+	if filepath.Dir(file) == "." && file != "main.go" {
+		return false
+	}
+	for _, pattern := range ignore {
+		if matched, _ := filepath.Match(strings.TrimSpace(pattern), filepath.Base(file)); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// redeployOperator builds and publishes the operator image, then rolls out
+// the new image to the operator deployment.
+func redeployOperator() (err error) {
+	// The targets stop the build with a panic when they fail, catch it so we keep watching
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("%v", r)
+		}
+	}()
+
+	// Call the targets directly because mg.Deps only runs a target once
+	Build()
+	Publish()
+	kubectl("set", "image", "deployment/"+operatorDeployment, "-n", getOperatorNamespace(), "manager="+getOperatorImage()).Run()
+	return waitForDeployment(getOperatorNamespace(), operatorDeployment, deployTimeout)
+}
+
+// Run the operator locally against the test cluster, in place of the deployed operator.
+func RunLocal() {
+	mg.Deps(EnsureCluster)
+
+	restore := prepareLocalOperator()
+	defer restore()
+
+	// Run the compiled binary instead of go run, which doesn't pass signals
+	// to the operator, so that it can shut down cleanly
+	must.RunV("go", "build", "-o", "bin/manager", "main.go")
+	operatorLog.Printf("Running the operator locally, press Ctrl+C to stop")
+	operator := shx.Command("bin/manager").Env("KUBECONFIG=" + os.Getenv("KUBECONFIG"))
+	mgx.Must(errors.Wrap(runUntilInterrupted(operator), "the operator stopped unexpectedly"))
+}
+
+// Run the operator locally under delve, so that a debugger can attach to it.
+func Debug() {
+	mg.Deps(EnsureCluster, EnsureDelve)
+
+	restore := prepareLocalOperator()
+	defer restore()
+
+	operatorLog.Printf("Starting delve, attach your debugger to localhost%s, press Ctrl+C to stop", delveAddress)
+	debugger := shx.Command("dlv", "debug", "./main.go", "--headless", "--listen="+delveAddress, "--api-version=2").
+		Env("KUBECONFIG=" + os.Getenv("KUBECONFIG"))
+	mgx.Must(errors.Wrap(runUntilInterrupted(debugger), "delve stopped unexpectedly"))
+}
+
+// prepareLocalOperator installs the CRDs and scales down the operator
+// deployment, so that it doesn't compete with an operator running locally.
+// It returns a function that restores the deployment.
+func prepareLocalOperator() func() {
+	installCRDs()
+
+	if !isOperatorDeployed() {
+		return func() {}
+	}
+
+	replicas, err := kubectl("get", "deployment", operatorDeployment, "-n", getOperatorNamespace(), "-o", "jsonpath={.spec.replicas}").Output()
+	mgx.Must(errors.Wrapf(err, "could not get the replicas of the %s deployment", operatorDeployment))
+	if replicas == "0" {
+		return func() {}
+	}
+
+	operatorLog.Printf("Scaling down the %s deployment while the operator runs locally", operatorDeployment)
+	kubectl("scale", "deployment", operatorDeployment, "-n", getOperatorNamespace(), "--replicas=0").Run()
+	return func() {
+		operatorLog.Printf("Scaling the %s deployment back up to %s replicas", operatorDeployment, replicas)
+		kubectl("scale", "deployment", operatorDeployment, "-n", getOperatorNamespace(), "--replicas="+replicas).Must(false).Run()
+	}
+}
+
+// installCRDs applies the operator's CRDs to the current cluster.
+func installCRDs() {
+	const crdDir = "config/crd"
+	if _, err := os.Stat(filepath.Join(crdDir, "kustomization.yaml")); os.IsNotExist(err) {
+		operatorLog.Debugf("Skipping installing CRDs, %s does not have a kustomization.yaml", crdDir)
+		return
+	}
+
+	mg.Deps(EnsureKustomize)
+	crds, err := kustomize("build", crdDir).Output()
+	mgx.Must(errors.Wrap(err, "could not build the CRD manifests"))
+	kubectl("apply", "-f", "-").Stdin(strings.NewReader(crds)).Run()
+	mgx.Must(waitForCRDs(crdEstablishedTimeout))
+}
+
+// runUntilInterrupted runs a long-lived command until it exits or this
+// process receives SIGINT or SIGTERM, which are passed along to the command
+// so that it can shut down cleanly.
+func runUntilInterrupted(cmd shx.PreparedCommand) error {
+	ctx, stop := notifyOnInterrupt()
+	defer stop()
+	return runWithContext(ctx, cmd)
+}
+
+// notifyOnInterrupt returns a context that is cancelled when this process
+// receives SIGINT or SIGTERM. Call the returned function to stop listening
+// for the signals once they are no longer handled.
+func notifyOnInterrupt() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// runWithContext runs a command until it exits or the context is cancelled.
+// When the context is cancelled, the command is interrupted, and killed if
+// it doesn't stop within 10 seconds, so that it isn't left running.
+func runWithContext(ctx context.Context, cmd shx.PreparedCommand) error {
+	if err := cmd.Cmd.Start(); err != nil {
+		return errors.Wrapf(err, "could not start %s", cmd)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Cmd.Wait() }()
+
+	select {
+	case <-ctx.Done():
+		// Windows doesn't support sending an interrupt, so kill it right away
+		if err := cmd.Cmd.Process.Signal(os.Interrupt); err != nil {
+			cmd.Cmd.Process.Kill()
+		}
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			operatorLog.Printf("%s did not stop after it was interrupted, killing it", cmd)
+			cmd.Cmd.Process.Kill()
+			<-done
+		}
+		return nil
+	case err := <-done:
+		return err
+	}
+}
+
+// isOperatorDeployed determines if the operator deployment exists in the current cluster.
+func isOperatorDeployed() bool {
+	err := kubectl("get", "deployment", operatorDeployment, "-n", getOperatorNamespace()).Must(false).RunS()
+	return err == nil
+}
+
+// getRegistryTags lists the tags of a repository in the local registry, for
+// example localhost:5000/porter-operator.
+func getRegistryTags(repository string) ([]string, error) {
+	client, err := getRegistryClient()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid repository %s, expected REGISTRY/NAME", repository)
+	}
+
+	tagsURL := fmt.Sprintf("%s://%s/v2/%s/tags/list", getRegistryScheme(), parts[0], parts[1])
+	resp, err := client.Get(tagsURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s", tagsURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return nil, errors.Errorf("GET %s: %s", tagsURL, resp.Status)
+	}
+
+	var result struct {
+		Tags []string `json:"tags"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Tags, errors.Wrapf(err, "error parsing the response from %s", tagsURL)
+}
+
+// getVersion returns the version of the operator, either from VERSION or git.
+func getVersion() string {
+	if version := os.Getenv("VERSION"); version != "" {
+		return version
+	}
+
+	version, err := shx.OutputS("git", "describe", "--tags", "--dirty", "--always")
+	if err != nil || version == "" {
+		return "dev"
+	}
+	return version
+}
+
+// getOperatorImageRepository returns the operator image repository, set with
+// PORTER_IMAGE_REPOSITORY, which defaults to the local registry.
+func getOperatorImageRepository() string {
+	return getEnvOrDefault("PORTER_IMAGE_REPOSITORY", fmt.Sprintf("localhost:%s/%s", getRegistryPort(), operatorImageName))
+}
+
+// getOperatorImageTag returns the operator image tag, set with
+// PORTER_IMAGE_TAG, which defaults to the version.
+func getOperatorImageTag() string {
+	return getEnvOrDefault("PORTER_IMAGE_TAG", getVersion())
+}
+
+// getOperatorImage returns the fully-qualified operator image reference.
+func getOperatorImage() string {
+	return getOperatorImageRepository() + ":" + getOperatorImageTag()
+}
+
+// isLocalRepository determines if an image repository is in the local registry.
+func isLocalRepository(repository string) bool {
+	return strings.HasPrefix(repository, "localhost:") || strings.HasPrefix(repository, "127.0.0.1:")
+}
+
+// getKindVersion returns the version of KIND to use.
+func getKindVersion() string {
+	return getEnvOrDefault("PORTER_KIND_VERSION", kindVersion)
+}
+
+// getKubeconfig returns the relative location of the KUBECONFIG for the KIND
+// cluster, so that using a dedicated cluster, like TestE2E does, doesn't
+// overwrite the kubeconfig of the test cluster.
+func getKubeconfig() string {
+	if name := getClusterName(); name != kindClusterName {
+		return fmt.Sprintf("kind-%s.config", name)
+	}
+	return kubeconfig
+}
+
+// getClusterName returns the name of the KIND cluster to use.
+func getClusterName() string {
+	return getEnvOrDefault("PORTER_KIND_CLUSTER", kindClusterName)
+}
+
+// getOperatorNamespace returns the namespace that the operator is deployed
+// to, set with PORTER_OPERATOR_NAMESPACE.
+func getOperatorNamespace() string {
+	return getEnvOrDefault("PORTER_OPERATOR_NAMESPACE", operatorNamespace)
+}
+
+// getRegistryPort returns the host port of the local registry.
+func getRegistryPort() string {
+	return getEnvOrDefault("PORTER_REGISTRY_PORT", registryPort)
+}
+
+// getEnvOrDefault returns the value of an environment variable, or the default when it isn't set.
+func getEnvOrDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Format the go code in place.
+func Fmt() {
+	must.RunV("go", "fmt", "./...")
+}
+
+// Check that the go code, including the magefile, is formatted, for CI.
+func FmtCheck() {
+	out, err := shx.OutputE("gofmt", "-l", ".")
+	mgx.Must(errors.Wrap(err, "could not check the formatting with gofmt"))
+
+	if out != "" {
+		mgx.Must(errors.Errorf("these files are not formatted, fix them with `mage Fmt`:\n%s", out))
+	}
+}
+
+func Vet() {
+	must.RunV("go", "vet", "./...")
+}
+
+// Run go vet and staticcheck, including on the magefile.
+func StaticCheck() {
+	mg.Deps(Vet, EnsureStaticCheck)
+
+	// The magefile is only included with the mage build tag
+	must.RunV("go", "vet", "-tags", "mage", ".")
+	must.RunV("staticcheck", "./...")
+	must.RunV("staticcheck", "-tags", "mage", ".")
+}
+
+// Run the formatter, linters and unit tests.
+func Check() {
+	mg.SerialDeps(Fmt, StaticCheck, TestUnit)
+}
+
+// Run all tests, including the integration tests when the test cluster exists.
+func Test() {
+	type testTarget struct {
+		name string
+		run  func()
+	}
+	targets := []testTarget{{"TestUnit", TestUnit}}
+
+	if race, _ := strconv.ParseBool(os.Getenv("PORTER_TEST_RACE")); race {
+		targets = append(targets, testTarget{"TestRace", TestRace})
+	}
+
+	if useCluster() {
+		targets = append(targets, testTarget{"TestIntegration", TestIntegration})
+	} else {
+		testLog.Printf("Skipping the integration tests because the %s kind cluster does not exist, create it with `mage EnsureCluster`", getClusterName())
+	}
+
+	var failed []string
+	for _, target := range targets {
+		if err := catchFailure(target.run); err != nil {
+			testLog.Printf("%s failed: %s", target.name, err)
+			failed = append(failed, target.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		mgx.Must(errors.Errorf("%s failed", strings.Join(failed, ", ")))
+	}
+}
+
+// catchFailure runs a target and returns its failure as an error, instead
+// of the panic that stops the build.
+func catchFailure(target func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("%v", r)
+		}
+	}()
+
+	target()
+	return nil
+}
+
+// Run unit tests.
+func TestUnit() {
+	packages := os.Getenv("PKG")
+	run := os.Getenv("RUN")
+
+	var args []string
+	if packages == "" && run == "" {
+		args = append(args, "./...", "-coverprofile", "coverage-unit.out")
+	} else {
+		if packages == "" {
+			packages = "./..."
+		}
+		args = append(args, strings.Fields(packages)...)
+		if run != "" {
+			args = append(args, "-run", run)
+		}
+	}
+	if count := os.Getenv("COUNT"); count != "" {
+		if _, err := strconv.Atoi(count); err != nil {
+			mgx.Must(errors.Errorf("invalid COUNT %q, it must be a number", count))
+		}
+		args = append(args, "-count", count)
+	}
+
+	if junit, _ := strconv.ParseBool(os.Getenv("PORTER_JUNIT")); junit {
+		mg.Deps(EnsureGotestsum)
+		mgx.Must(os.MkdirAll(testResultsDir, 0755))
+
+		// gotestsum runs go test -json with the arguments after --
+		report := filepath.Join(testResultsDir, "unit.xml")
+		must.RunV("gotestsum", append([]string{"--junitfile", report, "--format", "testname", "--"}, args...)...)
+		return
+	}
+
+	must.RunV("go", append([]string{"test"}, args...)...)
+}
+
+// Run the controller benchmarks, and compare them to the baseline when there is one.
+func Bench() {
+	count := getEnvOrDefault("COUNT", "5")
+	if _, err := strconv.Atoi(count); err != nil {
+		mgx.Must(errors.Errorf("invalid COUNT %q, it must be a number", count))
+	}
+	threshold, err := strconv.ParseFloat(getEnvOrDefault("PORTER_BENCH_THRESHOLD", defaultBenchThreshold), 64)
+	if err != nil || threshold < 0 {
+		mgx.Must(errors.Errorf("invalid PORTER_BENCH_THRESHOLD %q, expected a percentage", os.Getenv("PORTER_BENCH_THRESHOLD")))
+	}
+
+	output, err := os.Create(benchOutput)
+	mgx.Must(errors.Wrapf(err, "could not create %s", benchOutput))
+	defer output.Close()
+
+	// Exec instead of RunV, which would replace stdout
+	must.Command("go", "test", "-bench=.", "-benchmem", "-run=^$", "-count", count, "./controllers/...").
+		Stdout(io.MultiWriter(os.Stdout, output)).Exec()
+
+	baseline := getEnvOrDefault("PORTER_BENCH_BASELINE", benchBaseline)
+	if _, err := os.Stat(baseline); os.IsNotExist(err) {
+		testLog.Printf("There is no baseline to compare to, save one with `cp %s %s`", benchOutput, baseline)
+		return
+	}
+
+	mg.Deps(EnsureBenchstat)
+	must.RunV("benchstat", baseline, benchOutput)
+
+	before, err := parseBenchmarks(baseline)
+	mgx.Must(err)
+	after, err := parseBenchmarks(benchOutput)
+	mgx.Must(err)
+
+	var regressions []string
+	for name, nsPerOp := range after {
+		old, ok := before[name]
+		if !ok || old == 0 {
+			continue
+		}
+		if delta := (nsPerOp - old) / old * 100; delta > threshold {
+			regressions = append(regressions, fmt.Sprintf("%s: %.0f ns/op -> %.0f ns/op (+%.1f%%)", name, old, nsPerOp, delta))
+		}
+	}
+	if len(regressions) > 0 {
+		sort.Strings(regressions)
+		mgx.Must(errors.Errorf("these benchmarks are more than %g%% slower than %s:\n%s", threshold, baseline, strings.Join(regressions, "\n")))
+	}
+}
+
+// parseBenchmarks returns the mean ns/op of each benchmark in the output of
+// go test -bench, keyed by the benchmark name without the GOMAXPROCS suffix.
+func parseBenchmarks(file string) (map[string]float64, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", file)
+	}
+
+	totals := make(map[string]float64)
+	runs := make(map[string]int)
+	gomaxprocs := regexp.MustCompile(`-\d+$`)
+	for _, line := range strings.Split(string(contents), "\n") {
+		// e.g. BenchmarkReconcile-8   1000   1234 ns/op   512 B/op   8 allocs/op
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		for i := 3; i < len(fields); i++ {
+			if fields[i] != "ns/op" {
+				continue
+			}
+			nsPerOp, err := strconv.ParseFloat(fields[i-1], 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid ns/op in %s: %s", file, line)
+			}
+			name := gomaxprocs.ReplaceAllString(fields[0], "")
+			totals[name] += nsPerOp
+			runs[name]++
+		}
+	}
+
+	means := make(map[string]float64, len(totals))
+	for name, total := range totals {
+		means[name] = total / float64(runs[name])
+	}
+	return means, nil
+}
+
+// Run unit tests with the race detector, saving the output to test-results/race.log.
+func TestRace() {
+	mgx.Must(os.MkdirAll(testResultsDir, 0755))
+	logFile := filepath.Join(testResultsDir, "race.log")
+	output, err := os.Create(logFile)
+	mgx.Must(errors.Wrapf(err, "could not create %s", logFile))
+	defer output.Close()
+
+	// Exec instead of RunV, which would replace stdout
+	must.Command("go", "test", "-race", "./...", "-coverprofile", "coverage-race.out").
+		Stdout(io.MultiWriter(os.Stdout, output)).Stderr(io.MultiWriter(os.Stderr, output)).
+		Exec()
+}
+
+// Generate a coverage report from the unit and integration tests.
+func Coverage() {
+	mg.Deps(TestUnit)
+
+	profiles := []string{"coverage-unit.out"}
+	if _, err := os.Stat("coverage-integration.out"); err == nil {
+		profiles = append(profiles, "coverage-integration.out")
+	}
+
+	testLog.Printf("Merging coverage from %s", strings.Join(profiles, ", "))
+	mgx.Must(mergeCoverageProfiles("coverage.out", profiles...))
+
+	summary, err := shx.OutputE("go", "tool", "cover", "-func", "coverage.out")
+	mgx.Must(errors.Wrap(err, "could not summarize coverage.out"))
+	lines := strings.Split(summary, "\n")
+	fmt.Println(lines[len(lines)-1])
+
+	must.RunE("go", "tool", "cover", "-html", "coverage.out", "-o", "coverage.html")
+	testLog.Printf("Wrote coverage.html")
+}
+
+// mergeCoverageProfiles combines go coverage profiles into a single profile.
+// Blocks that appear in more than one profile have their counts added
+// together, or for the set mode, are covered if any profile covered them.
+func mergeCoverageProfiles(dest string, profiles ...string) error {
+	var mode string
+	var blocks []string
+	counts := make(map[string]int64)
+
+	for _, profile := range profiles {
+		contents, err := ioutil.ReadFile(profile)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s", profile)
+		}
+
+		for i, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+			if i == 0 {
+				profileMode := strings.TrimPrefix(line, "mode: ")
+				if mode != "" && mode != profileMode {
+					return errors.Errorf("cannot merge %s, it has mode %s but the others have %s", profile, profileMode, mode)
+				}
+				mode = profileMode
+				continue
+			}
+
+			// Each line is BLOCK NUMSTMTS COUNT, where BLOCK is file:start,end
+			sep := strings.LastIndex(line, " ")
+			if sep < 0 {
+				continue
+			}
+			block := line[:sep]
+			count, err := strconv.ParseInt(line[sep+1:], 10, 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid line in %s: %s", profile, line)
+			}
+
+			existing, ok := counts[block]
+			if !ok {
+				blocks = append(blocks, block)
+			}
+			if mode == "set" {
+				if count > 0 || existing > 0 {
+					count = 1
+				}
+				counts[block] = count
+			} else {
+				counts[block] = existing + count
+			}
+		}
+	}
+
+	var merged bytes.Buffer
+	fmt.Fprintf(&merged, "mode: %s\n", mode)
+	for _, block := range blocks {
+		fmt.Fprintf(&merged, "%s %d\n", block, counts[block])
+	}
+	return errors.Wrapf(ioutil.WriteFile(dest, merged.Bytes(), 0644), "error writing %s", dest)
+}
+
+// Run the integration tests with the operator reading from the informer cache, and then from the API server.
+func TestCacheModes() {
+	mg.Deps(EnsureCluster, EnsureGinkgo)
+	defer dumpClusterStateOnFailure()
+	// The mode is selected with the operator's --direct-reads flag, so the
+	// operator is run locally with the flag while the deployed one is scaled down
+	defer prepareLocalOperator()()
+
+	modes := []struct {
+		name        string
+		directReads bool
+	}{
+		{name: "cached", directReads: false},
+		{name: "direct", directReads: true},
+	}
+
+	var failed []string
+	for _, mode := range modes {
+		testLog.Printf("Running integration tests with %s reads", mode.name)
+		err := runIntegrationTestsAgainstLocalOperator("integration-"+mode.name, "--direct-reads="+strconv.FormatBool(mode.directReads))
+		if err != nil {
+			testLog.Printf("Integration tests failed with %s reads: %s", mode.name, err)
+			failed = append(failed, mode.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		mgx.Must(errors.Errorf("integration tests failed with %s reads", strings.Join(failed, " and ")))
+	}
+}
+
+// runIntegrationTestsAgainstLocalOperator builds the operator and runs it
+// locally with the specified flags, against the test cluster, while the
+// integration tests execute.
+func runIntegrationTestsAgainstLocalOperator(reportName string, operatorArgs ...string) error {
+	must.RunV("go", "build", "-o", "bin/manager", "main.go")
+
+	operator := shx.Command("bin/manager", operatorArgs...).Env("KUBECONFIG=" + os.Getenv("KUBECONFIG"))
+	if err := operator.Cmd.Start(); err != nil {
+		return errors.Wrap(err, "could not start the operator")
+	}
+	defer func() {
+		operator.Cmd.Process.Kill()
+		operator.Cmd.Wait()
+	}()
+
+	return runIntegrationTests(reportName)
+}
+
+// Run the integration tests against the operator deployed to the test cluster.
+func TestIntegration() {
+	mg.Deps(EnsureCluster, Deploy, EnsureGinkgo)
+	defer dumpClusterStateOnFailure()
+
+	if err := runIntegrationTests("integration"); err != nil {
+		dumpOperatorLogs()
+		mgx.Must(err)
+	}
+}
+
+// Run the end-to-end tests in a dedicated KIND cluster, named porter-e2e.
+func TestE2E() {
+	defer useDedicatedCluster(e2eClusterName)()
+	defer dumpClusterStateOnFailure()
+
+	// EnsureCluster and Deploy may already have run against the test cluster,
+	// so the dedicated cluster is set up with the helpers that aren't memoized
+	mg.Deps(EnsureGinkgo)
+	ensureCluster()
+	deploy()
+
+	mgx.Must(runGinkgoSuites(e2eTestsDir, "e2e"))
+}
+
+// useDedicatedCluster switches to a KIND cluster used only by the calling
+// target, with its own kubeconfig, so that the test cluster is left alone.
+// A copy left behind by an interrupted run is deleted first, to start clean.
+// Defer the returned function to delete the cluster when the target is done,
+// and switch back to the previous cluster for any targets that run after it.
+func useDedicatedCluster(name string) func() {
+	restoreCluster := saveEnv("PORTER_KIND_CLUSTER")
+	restoreKubeconfig := saveEnv("KUBECONFIG")
+
+	os.Setenv("PORTER_KIND_CLUSTER", name)
+	DeleteKindCluster()
+	return func() {
+		DeleteKindCluster()
+		restoreCluster()
+		restoreKubeconfig()
+	}
+}
+
+// saveEnv returns a function that restores an environment variable to its
+// current value, or unsets it when it isn't set.
+func saveEnv(key string) func() {
+	original, ok := os.LookupEnv(key)
+	return func() {
+		if ok {
+			os.Setenv(key, original)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// Save the state of the test cluster, and the operator and flux logs, to debug-logs.
+func DumpClusterState() {
+	mg.Deps(EnsureKubectl, EnsureKind)
+
+	if !useCluster() {
+		kindLog.Printf("The %s kind cluster does not exist, so there is nothing to dump", getClusterName())
+		return
+	}
+	dumpClusterState()
+}
+
+// dumpClusterStateOnFailure dumps the state of the cluster when the target
+// that deferred it fails, and then continues failing the target.
+func dumpClusterStateOnFailure() {
+	if r := recover(); r != nil {
+		dumpClusterState()
+		panic(r)
+	}
+}
+
+// dumpClusterState saves the state of the current cluster to a new
+// directory in debug-logs. Failures are reported but don't stop the build,
+// so that as much as possible is collected.
+func dumpClusterState() {
+	dir := filepath.Join(debugLogsDir, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		kindLog.Printf("Could not create %s: %s", dir, err)
+		return
+	}
+	kindLog.Printf("Saving the state of the %s cluster to %s", getClusterName(), dir)
+
+	saveCommandOutput(filepath.Join(dir, "resources.txt"),
+		kubectl("get", "all", "--all-namespaces", "-o", "wide"))
+	saveCommandOutput(filepath.Join(dir, "operator-deployment.txt"),
+		kubectl("describe", "deployment", operatorDeployment, "-n", getOperatorNamespace()))
+	saveCommandOutput(filepath.Join(dir, "operator-pods.txt"),
+		kubectl("describe", "pods", "-n", getOperatorNamespace(), "-l", "control-plane=controller-manager"))
+	saveControllerLogs(dir)
+	saveFluxEvents(filepath.Join(dir, "flux-events.txt"))
+
+	err := shx.Command("kind", "export", "logs", filepath.Join(dir, "kind"), "--name", getClusterName()).RunS()
+	if err != nil {
+		kindLog.Printf("Could not export the kind logs: %s", err)
+	}
+}
+
+// saveCommandOutput runs a command and writes its output to a file, or the
+// error when the command fails.
+func saveCommandOutput(file string, cmd shx.PreparedCommand) {
+	var output bytes.Buffer
+	_, _, err := cmd.Must(false).Stdout(&output).Stderr(&output).Exec()
+	if err != nil {
+		fmt.Fprintf(&output, "\n%s\n", err)
+	}
+	if err := ioutil.WriteFile(file, output.Bytes(), 0644); err != nil {
+		kindLog.Printf("Could not write %s: %s", file, err)
+	}
+}
+
+// saveControllerLogs writes the logs of the operator and the flux controllers
+// to a directory, one file per controller.
+func saveControllerLogs(dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		kindLog.Printf("Could not create %s: %s", dir, err)
+		return
+	}
+
+	type controller struct{ namespace, deployment string }
+	controllers := []controller{{getOperatorNamespace(), operatorDeployment}}
+	for _, component := range strings.Split(getFluxComponents(), ",") {
+		controllers = append(controllers, controller{fluxNamespace, strings.TrimSpace(component)})
+	}
+
+	for _, c := range controllers {
+		logs, err := kubectl("logs", "deployment/"+c.deployment, "-n", c.namespace, "--all-containers").
+			Must(false).OutputS()
+		if err != nil {
+			kindLog.Printf("Could not retrieve the %s logs: %s", c.deployment, err)
+			continue
+		}
+
+		logFile := filepath.Join(dir, c.deployment+".log")
+		if err := ioutil.WriteFile(logFile, []byte(logs), 0644); err != nil {
+			kindLog.Printf("Could not write %s: %s", logFile, err)
+		}
+	}
+	kindLog.Printf("Saved the controller logs to %s", dir)
+}
+
+// runIntegrationTests executes the ginkgo integration suites, if any exist,
+// writing a JUnit report named reportName.xml to the test-results directory.
+func runIntegrationTests(reportName string) error {
+	return runGinkgoSuites(integrationTestsDir, reportName)
+}
+
+// runGinkgoSuites executes the ginkgo suites in a directory, if any exist,
+// writing a JUnit report named reportName.xml to the test-results directory.
+func runGinkgoSuites(dir string, reportName string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		testLog.Printf("No tests found in %s", dir)
+		return nil
+	}
+
+	err := os.MkdirAll(testResultsDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "could not create %s", testResultsDir)
+	}
+
+	var focus, skip, labels, procs string
+	if value := os.Getenv("GINKGO_FOCUS"); value != "" {
+		focus = "--focus=" + value
+	}
+	if value := os.Getenv("GINKGO_SKIP"); value != "" {
+		skip = "--skip=" + value
+	}
+	if value := os.Getenv("GINKGO_LABELS"); value != "" {
+		labels = "--label-filter=" + value
+	}
+	if value := os.Getenv("GINKGO_NODES"); value != "" {
+		if nodes, err := strconv.Atoi(value); err != nil || nodes < 1 {
+			return errors.Errorf("invalid GINKGO_NODES %q, expected the number of parallel processes", value)
+		}
+		procs = "--procs=" + value
+	}
+
+	return shx.Command("ginkgo", "-r", focus, skip, labels, procs,
+		"--output-dir="+testResultsDir, "--junit-report="+reportName+".xml", dir).
+		CollapseArgs().Env("KUBECONFIG=" + os.Getenv("KUBECONFIG")).RunV()
+}
+
+// dumpOperatorLogs prints the recent operator logs and saves them to the
+// test-results directory, to help debug test failures.
+func dumpOperatorLogs() {
+	if !isOperatorDeployed() {
+		return
+	}
+
+	logs, err := kubectl("logs", "deployment/"+operatorDeployment, "-n", getOperatorNamespace(), "-c", "manager", "--tail=500").
+		Must(false).OutputS()
+	if err != nil {
+		testLog.Printf("Could not retrieve the operator logs: %s", err)
+		return
+	}
+
+	testLog.Printf("Operator logs:\n%s", logs)
+	os.MkdirAll(testResultsDir, 0755)
+	logFile := filepath.Join(testResultsDir, "operator.log")
+	if err := ioutil.WriteFile(logFile, []byte(logs), 0644); err != nil {
+		testLog.Printf("Could not write %s: %s", logFile, err)
+	}
+}
+
+// Quickly check that the deployed operator works, without running the test suites.
+func Smoke() {
+	mg.Deps(Deploy, SetupTestNamespace)
+
+	defer kubectl("delete", "gitrepository", smokeName, "-n", testNamespace, "--ignore-not-found").Must(false).Run()
+
+	createGitRepository(testNamespace, smokeName)
+	mgx.Must(waitForReconciledRepository(testNamespace, smokeName, smokeTimeout))
+	testLog.Printf("The operator reconciled the GitRepository")
+}
+
+// createGitRepository creates a GitRepository for the operator to reconcile.
+func createGitRepository(namespace string, name string) {
+	manifest := fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta1
+kind: GitRepository
+metadata:
+  name: %s
+  namespace: %s
+spec:
+  interval: 10m
+  url: %s
+  ref:
+    branch: master
+`, name, namespace, smokeRepository)
+
+	testLog.Printf("Creating the %s GitRepository in the %s namespace", name, namespace)
+	kubectl("apply", "-f", "-").Stdin(strings.NewReader(manifest)).Run()
+}
+
+// waitForReconciledRepository waits for flux to mark a GitRepository as
+// ready, and then for the operator to process its artifact. When the timeout
+// expires, the operator logs are printed to help debug why.
+func waitForReconciledRepository(namespace string, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if err := waitForCondition(namespace, "gitrepository", name, "Ready", timeout); err != nil {
+		return err
+	}
+
+	for {
+		logs, _ := kubectl("logs", "deployment/"+operatorDeployment, "-n", getOperatorNamespace(), "-c", "manager").Must(false).OutputS()
+		if hasReconciledRevision(logs, name) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			testLog.Printf("Operator logs:\n%s", logs)
+			return errors.Errorf("the operator did not reconcile the %s GitRepository within %s", name, timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Test upgrading the operator from the last release to the current code.
+func TestUpgrade() {
+	mg.Deps(EnsureKubectl)
+
+	from, err := getUpgradeFromVersion()
+	mgx.Must(err)
+
+	defer useDedicatedCluster(upgradeClusterName)()
+	defer dumpClusterStateOnFailure()
+
+	// The memoized targets may already have run against the test cluster
+	ensureCluster()
+
+	manifestURL := fmt.Sprintf(releaseManifestURL, from)
+	testLog.Printf("Deploying the %s release of the operator from %s", from, manifestURL)
+	kubectl("apply", "-f", manifestURL).Run()
+	err = waitForDeployment(operatorNamespace, operatorDeployment, deployTimeout)
+	mgx.Must(errors.Wrapf(err, "the %s release of the operator did not start", from))
+
+	setupTestNamespace()
+	createGitRepository(testNamespace, upgradeRepositoryName)
+	err = waitForReconciledRepository(testNamespace, upgradeRepositoryName, smokeTimeout)
+	mgx.Must(errors.Wrapf(err, "the %s release of the operator did not reconcile the GitRepository", from))
+
+	testLog.Printf("Upgrading the operator from %s to %s", from, getOperatorImage())
+	deploy()
+
+	mgx.Must(checkCustomResourcesReadable())
+	err = waitForReconciledRepository(testNamespace, upgradeRepositoryName, smokeTimeout)
+	mgx.Must(errors.Wrap(err, "the upgraded operator did not reconcile the existing GitRepository"))
+	testLog.Printf("The operator was upgraded from %s without breaking the existing resources", from)
+}
+
+// getUpgradeFromVersion returns the release that TestUpgrade upgrades from,
+// set with PORTER_UPGRADE_FROM, or the latest release tag before the current
+// commit.
+func getUpgradeFromVersion() (string, error) {
+	if from := os.Getenv("PORTER_UPGRADE_FROM"); from != "" {
+		if !semverTag.MatchString(from) {
+			return "", errors.Errorf("invalid PORTER_UPGRADE_FROM %q, expected a release tag such as v1.2.3", from)
+		}
+		return from, nil
+	}
+
+	current, _ := shx.OutputS("git", "describe", "--tags", "--exact-match")
+	tags, err := shx.OutputS("git", "tag", "--list", "v*", "--merged", "HEAD", "--sort=-v:refname")
+	if err != nil {
+		return "", errors.Wrap(err, "could not list the release tags")
+	}
+	for _, tag := range strings.Fields(tags) {
+		if tag != current && semverTag.MatchString(tag) {
+			return tag, nil
+		}
+	}
+	return "", errors.New("no release was found to upgrade from, set PORTER_UPGRADE_FROM to a release tag such as v1.2.3")
+}
+
+// checkCustomResourcesReadable lists the custom resources of each of the
+// operator's CRDs, which fails when a CRD change breaks the stored resources.
+func checkCustomResourcesReadable() error {
+	names, err := getCRDNames(crdBasesDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if out, err := kubectl("get", name, "--all-namespaces").Must(false).OutputE(); err != nil {
+			return errors.Wrapf(err, "the %s resources could not be read after the upgrade: %s", name, out)
+		}
+	}
+	return nil
+}
+
+// hasReconciledRevision determines if the operator logs show that it
+// processed a revision of the named GitRepository.
+func hasReconciledRevision(logs string, name string) bool {
+	for _, line := range strings.Split(logs, "\n") {
+		if strings.Contains(line, "New revision detected") && strings.Contains(line, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create many GitRepository resources and verify that the operator reconciles all of them.
+func TestScale() {
+	mg.Deps(EnsureCluster)
+
+	count := defaultScaleCount
+	if value := os.Getenv("SCALE_COUNT"); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		mgx.Must(errors.Wrapf(err, "invalid SCALE_COUNT %q", value))
+	}
+
+	timeout := defaultScaleTimeout
+	if value := os.Getenv("SCALE_TIMEOUT"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		mgx.Must(errors.Wrapf(err, "invalid SCALE_TIMEOUT %q", value))
+	}
+
+	repo := os.Getenv("SCALE_REPO")
+	if repo == "" {
+		repo = defaultScaleRepository
+	}
+
+	pod, err := getOperatorPod()
+	mgx.Must(errors.Wrap(err, "the operator must be deployed to run the scale test"))
+
+	startReconciles := getOperatorMetrics(pod).sum("controller_runtime_reconcile_total")
+	startRequests := getAPIServerMetrics().sum("apiserver_request_total")
+	startCPU := getOperatorMetrics(pod).sum("process_cpu_seconds_total")
+
+	var manifests bytes.Buffer
+	fmt.Fprintf(&manifests, "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: %s\n", scaleNamespace)
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&manifests, `---
+apiVersion: source.toolkit.fluxcd.io/v1beta1
+kind: GitRepository
+metadata:
+  name: scale-%d
+  namespace: %s
+spec:
+  interval: 10m
+  url: %s
+  ref:
+    branch: master
+`, i, scaleNamespace, repo)
+	}
+
+	defer func() {
+		testLog.Printf("Cleaning up the %s namespace", scaleNamespace)
+		kubectl("delete", "namespace", scaleNamespace, "--ignore-not-found").Must(false).Run()
+	}()
+
+	testLog.Printf("Creating %d GitRepository resources in the %s namespace", count, scaleNamespace)
+	start := time.Now()
+	kubectl("apply", "-f", "-").Stdin(&manifests).Run()
+
+	deadline := start.Add(timeout)
+	for {
+		mgx.Must(checkOperatorHealthy(pod))
+
+		readyRepos := countReadyGitRepositories(scaleNamespace)
+		reconciles := getOperatorMetrics(pod).sum("controller_runtime_reconcile_total") - startReconciles
+		testLog.Printf("%s: %d/%d ready, %.0f reconciles", time.Since(start).Round(time.Second), readyRepos, count, reconciles)
+		if readyRepos >= count && reconciles >= float64(count) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			mgx.Must(errors.Errorf("timed out after %s waiting for %d GitRepository resources to be reconciled", timeout, count))
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	elapsed := time.Since(start)
+	metrics := getOperatorMetrics(pod)
+	requests := getAPIServerMetrics().sum("apiserver_request_total") - startRequests
+	cpu := metrics.sum("process_cpu_seconds_total") - startCPU
+
+	fmt.Printf("\nConverged %d resources in %s\n", count, elapsed.Round(time.Second))
+	fmt.Printf("Operator memory: %s\n", formatBytes(int64(metrics.sum("process_resident_memory_bytes"))))
+	fmt.Printf("Operator CPU: %.1f cores\n", cpu/elapsed.Seconds())
+	fmt.Printf("API server request rate: %.1f req/s\n", requests/elapsed.Seconds())
+}
+
+// getOperatorPod returns the name of a running operator pod.
+func getOperatorPod() (string, error) {
+	selector, err := getDeploymentSelector(getOperatorNamespace(), operatorDeployment)
+	if err != nil {
+		return "", err
+	}
+
+	pod, err := kubectl("get", "pods", "-n", getOperatorNamespace(), "-l", selector,
+		"--field-selector=status.phase=Running", "-o", "jsonpath={.items[0].metadata.name}").Must(false).OutputE()
+	if err != nil || pod == "" {
+		return "", errors.Errorf("no running pods found for the %s deployment", operatorDeployment)
+	}
+	return pod, nil
+}
+
+// checkOperatorHealthy returns an error when the operator pod has restarted or is gone.
+func checkOperatorHealthy(pod string) error {
+	status, err := kubectl("get", "pod", pod, "-n", getOperatorNamespace(),
+		"-o", "jsonpath={.status.containerStatuses[*].restartCount} {.status.containerStatuses[*].lastState.terminated.reason}").Must(false).OutputS()
+	if err != nil {
+		return errors.Errorf("the operator pod %s is gone", pod)
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) > 0 && fields[0] != "0" {
+		reason := "unknown"
+		if len(fields) > 1 {
+			reason = fields[1]
+		}
+		return errors.Errorf("the operator pod %s restarted (%s)", pod, reason)
+	}
+	return nil
+}
+
+// countReadyGitRepositories returns the number of GitRepository resources in
+// the namespace with the Ready condition.
+func countReadyGitRepositories(namespace string) int {
+	out, _ := kubectl("get", "gitrepositories", "-n", namespace,
+		"-o", `jsonpath={range .items[*]}{.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}`).Must(false).OutputS()
+	return strings.Count(out, "True")
+}
+
+// getOperatorMetrics scrapes the operator's metrics endpoint through the API server.
+func getOperatorMetrics(pod string) metricSamples {
+	out, _ := kubectl("get", "--raw", fmt.Sprintf("/api/v1/namespaces/%s/pods/%s:8080/proxy/metrics", getOperatorNamespace(), pod)).Must(false).OutputS()
+	return parseMetrics(out)
+}
+
+// getAPIServerMetrics scrapes the API server's metrics endpoint.
+func getAPIServerMetrics() metricSamples {
+	out, _ := kubectl("get", "--raw", "/metrics").Must(false).OutputS()
+	return parseMetrics(out)
+}
+
+// Ensure operator-sdk is installed.
+func EnsureOperatorSDK() {
+	if runtime.GOOS == "windows" {
+		mgx.Must(errors.New("Sorry, OperatorSDK does not support Windows. In order to contribute to this repository, you will need to use WSL."))
+	}
+	if installFromToolsDir("operator-sdk") {
+		return
+	}
+
+	url := withToolArch("operator-sdk", "https://github.com/operator-framework/operator-sdk/releases/download/{{.VERSION}}/operator-sdk_{{.GOOS}}_{{.GOARCH}}")
+	checksumsURL := "https://github.com/operator-framework/operator-sdk/releases/download/{{.VERSION}}/checksums.txt"
+	mgx.Must(downloadAndVerify(url, checksumsURL, "operator-sdk", operatorSDKVersion))
+}
+
+// Ensure that the test KIND cluster is up.
+func EnsureCluster() {
+	ensureCluster()
+}
+
+// ensureCluster makes sure that the current cluster, set by
+// PORTER_KIND_CLUSTER, is up. Unlike EnsureCluster, it isn't memoized by mage,
+// so a target that switches to a dedicated cluster can create it too.
+func ensureCluster() {
+	mg.Deps(EnsureKubectl)
+
+	if useExistingCluster() {
+		if !useCluster() {
+			mgx.Must(errors.Errorf("PORTER_USE_EXISTING_CLUSTER is set but the cluster in KUBECONFIG %q is not reachable", os.Getenv("KUBECONFIG")))
+		}
+	} else if useCluster() {
+		keep, _ := strconv.ParseBool(os.Getenv("PORTER_KEEP_CLUSTER"))
+		if staleReason := getClusterStaleReason(); staleReason != "" && !keep {
+			kindLog.Printf("Recreating the kind cluster because %s, set PORTER_KEEP_CLUSTER=true to keep it", staleReason)
+			must.RunE("kind", "delete", "cluster", "--name", getClusterName())
+			CreateKindCluster()
+		}
+	} else {
+		// The cluster may exist but be unusable, e.g. its container was stopped
+		if _, exists := getClusterConfig(); exists {
+			kindLog.Printf("Deleting the unreachable kind cluster so that it can be recreated")
+			must.RunE("kind", "delete", "cluster", "--name", getClusterName())
+		}
+		CreateKindCluster()
+	}
+	requireKindContext()
+	configureCluster()
+}
+
+// getClusterVersions returns the versions used to create a cluster with the
+// current settings, which are recorded in the clusterInfoConfigMap.
+func getClusterVersions() map[string]string {
+	nodeImage, err := getKindNodeImage()
+	mgx.Must(err)
+	if nodeImage == "" {
+		nodeImage = "default"
+	}
+	cni, err := getKindCNI()
+	mgx.Must(err)
+	return map[string]string{"kindVersion": getKindVersion(), "nodeImage": nodeImage, "cni": cni}
+}
+
+// Versions that are assumed for clusters created before they were recorded
+var clusterVersionDefaults = map[string]string{"cni": defaultKindCNI}
+
+// recordClusterVersions saves the versions used to create the current
+// cluster, so that EnsureCluster can detect when it is out of date.
+func recordClusterVersions() {
+	args := []string{"create", "configmap", clusterInfoConfigMap, "-n", "kube-public"}
+	for key, value := range getClusterVersions() {
+		args = append(args, fmt.Sprintf("--from-literal=%s=%s", key, value))
+	}
+	kubectl(args...).RunS()
+}
+
+// getClusterStaleReason compares the versions recorded when the current
+// cluster was created to the current settings, and describes the first
+// difference. An empty string is returned when the cluster is up-to-date.
+//
+// Clusters created before the versions were recorded are assumed to be
+// up-to-date, rather than recreating every existing cluster. The current
+// versions are recorded for them, so later changes are detected.
+func getClusterStaleReason() string {
+	if err := kubectl("get", "configmap", clusterInfoConfigMap, "-n", "kube-public").Must(false).RunS(); err != nil {
+		kindLog.Printf("WARNING: the versions that the %s cluster was created with are unknown, assuming that they are the current versions. Recreate it with `mage DeleteKindCluster EnsureCluster` if it is out of date", getClusterName())
+		recordClusterVersions()
+		return ""
+	}
+
+	versions := getClusterVersions()
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		want := versions[key]
+		got, err := kubectl("get", "configmap", clusterInfoConfigMap, "-n", "kube-public",
+			"-o", fmt.Sprintf("jsonpath={.data.%s}", key)).Must(false).OutputS()
+		if err != nil {
+			kindLog.Printf("Could not read the versions that the %s cluster was created with: %s", getClusterName(), err)
+			return ""
+		}
+		if got == "" {
+			got = clusterVersionDefaults[key]
+		}
+		if got != want {
+			return fmt.Sprintf("it was created with %s %s instead of %s", key, got, want)
+		}
+	}
+	return ""
+}
+
+// get the config of the current kind cluster, if available
+func getClusterConfig() (kubeconfig string, ok bool) {
+	contents, err := shx.OutputE("kind", "get", "kubeconfig", "--name", getClusterName())
+	return contents, err == nil
+}
+
+// useExistingCluster determines if the tests should use the cluster in
+// KUBECONFIG instead of a kind cluster, set with PORTER_USE_EXISTING_CLUSTER.
+func useExistingCluster() bool {
+	existing, _ := strconv.ParseBool(os.Getenv("PORTER_USE_EXISTING_CLUSTER"))
+	return existing
+}
+
+// Check that KUBECONFIG points to the project's kind cluster.
+func CheckKubeconfig() {
+	mg.Deps(EnsureKubectl)
+
+	useCluster()
+	requireKindContext()
+	kindLog.Printf("KUBECONFIG points to the %s kind cluster", getClusterName())
+}
+
+// requireKindContext stops the build unless the current kubectl context is
+// the project's kind cluster, or PORTER_ALLOW_NONKIND=true. Call it before
+// changing the cluster, after useCluster has set KUBECONFIG.
+func requireKindContext() {
+	if allow, _ := strconv.ParseBool(os.Getenv("PORTER_ALLOW_NONKIND")); allow {
+		return
+	}
+
+	expected := "kind-" + getClusterName()
+	current, err := kubectl("config", "current-context").Must(false).OutputS()
+	if err != nil {
+		mgx.Must(errors.Wrapf(err, "could not determine the current context of KUBECONFIG %q", os.Getenv("KUBECONFIG")))
+	}
+	if current != expected {
+		mgx.Must(errors.Errorf("refusing to continue because the current context of KUBECONFIG %q is %s instead of %s. Run `export KUBECONFIG=%s`, or set PORTER_ALLOW_NONKIND=true to use this cluster anyway",
+			os.Getenv("KUBECONFIG"), current, expected, filepath.Join(pwd(), getKubeconfig())))
+	}
+}
+
+// setup environment to use the current kind cluster, if available
+func useCluster() bool {
+	if useExistingCluster() {
+		err := kubectl("get", "namespaces", "--request-timeout=5s").Must(false).RunS()
+		return err == nil
+	}
+
+	contents, ok := getClusterConfig()
+	if ok {
+		userKubeConfig, _ := filepath.Abs(os.Getenv("KUBECONFIG"))
+		currentKubeConfig := filepath.Join(pwd(), getKubeconfig())
+		if userKubeConfig != currentKubeConfig {
+			fmt.Printf("ATTENTION! You should set your KUBECONFIG to match the cluster used by this project\n\n\texport KUBECONFIG=%s\n\n", currentKubeConfig)
+		}
+		os.Setenv("KUBECONFIG", currentKubeConfig)
+
+		err := ioutil.WriteFile(getKubeconfig(), []byte(contents), 0644)
+		mgx.Must(errors.Wrapf(err, "error writing %s", getKubeconfig()))
+
+		// kind can return a kubeconfig even when the cluster isn't running
+		err = kubectl("get", "namespaces", "--request-timeout=5s").Must(false).RunS()
+		if err != nil {
+			kindLog.Printf("The existing kind cluster %s is not reachable", getClusterName())
+			return false
+		}
+
+		kindLog.Printf("Reusing existing kind cluster")
+		setClusterNamespace(getOperatorNamespace())
+		return true
+	}
+
+	return false
+}
+
+// Create the test namespace for manual testing and make it the current namespace.
+func SetupTestNamespace() {
+	mg.Deps(EnsureCluster)
+	setupTestNamespace()
+}
+
+// setupTestNamespace creates the test namespace in the current cluster,
+// without being memoized by mage like SetupTestNamespace.
+func setupTestNamespace() {
+	kindLog.Printf("Setting up the %s namespace", testNamespace)
+	mgx.Must(applyTemplate("hack/test-namespace.yaml", struct{ Namespace string }{testNamespace}))
+	if useRegistryAuth() {
+		mgx.Must(createRegistryPullSecret(testNamespace))
+	}
+	setClusterNamespace(testNamespace)
+}
+
+// Configure the test namespace so that the operator can run installations in it.
+func ConfigureTestNamespace() {
+	mg.Deps(SetupTestNamespace)
+
+	data := struct{ Namespace string }{testNamespace}
+	kindLog.Printf("Configuring the %s namespace for installations", testNamespace)
+	mgx.Must(applyTemplate("testdata/test-namespace/porter-agent.yaml", data))
+	mgx.Must(applyTemplate("testdata/test-namespace/porter-config.yaml", data))
+}
+
+// Delete the porter resources, jobs and pods in the test namespace.
+func ResetTestNamespace() {
+	mg.Deps(EnsureKubectl)
+
+	if !useCluster() {
+		kindLog.Printf("The %s kind cluster does not exist, so there is nothing to reset", getClusterName())
+		return
+	}
+	requireKindContext()
+
+	resources, err := kubectl("api-resources", "--api-group="+porterAPIGroup, "--namespaced", "-o", "name").Must(false).OutputS()
+	mgx.Must(errors.Wrapf(err, "could not list the %s resources", porterAPIGroup))
+
+	kindLog.Printf("Resetting the %s namespace", testNamespace)
+	for _, resource := range strings.Fields(resources) {
+		mgx.Must(deleteTestResources(resource, "--all"))
+	}
+	mgx.Must(deleteTestResources("jobs,pods", "-l", porterJobSelector))
+}
+
+// deleteTestResources deletes resources from the test namespace and waits for
+// them to be removed. When they aren't removed in time, because a finalizer
+// can't complete, their finalizers are removed and they are deleted again.
+func deleteTestResources(resource string, selector ...string) error {
+	deleteArgs := append([]string{"delete", resource, "-n", testNamespace, "--ignore-not-found", fmt.Sprintf("--timeout=%s", undeployTimeout)}, selector...)
+	if err := kubectl(deleteArgs...).Must(false).RunE(); err == nil {
+		return nil
+	}
+
+	kindLog.Printf("Timed out waiting for the %s to be deleted, removing finalizers", resource)
+	getArgs := append([]string{"get", resource, "-n", testNamespace, "-o", `jsonpath={range .items[*]}{.kind} {.metadata.name}{"\n"}{end}`}, selector...)
+	remaining, _ := kubectl(getArgs...).Must(false).OutputS()
+	for _, line := range strings.Split(remaining, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		removeFinalizers(fields[0], testNamespace, fields[1])
+	}
+
+	err := kubectl(deleteArgs...).Must(false).RunE()
+	return errors.Wrapf(err, "could not delete the %s in the %s namespace", resource, testNamespace)
+}
+
+// applyTemplate renders a template of Kubernetes manifests and applies them
+// to the current cluster.
+func applyTemplate(file string, data interface{}) error {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", file)
+	}
+
+	tmpl, err := template.New(filepath.Base(file)).Parse(string(contents))
+	if err != nil {
+		return errors.Wrapf(err, "error parsing the template %s", file)
+	}
+
+	var manifests bytes.Buffer
+	if err := tmpl.Execute(&manifests, data); err != nil {
+		return errors.Wrapf(err, "error rendering the template %s", file)
+	}
+	return errors.Wrapf(kubectl("apply", "-f", "-").Must(false).Stdin(&manifests).RunE(), "could not apply %s", file)
+}
+
+func setClusterNamespace(name string) {
+	must.RunE("kubectl", "config", "set-context", "--current", "--namespace", name)
+}
+
+// Create a KIND cluster, named porter by default.
+func CreateKindCluster() {
+	mg.Deps(EnsureKind)
+
+	os.Setenv("KUBECONFIG", filepath.Join(pwd(), getKubeconfig()))
+
+	workers, err := getKindWorkers()
+	mgx.Must(err)
+	mirror, err := getRegistryMirror()
+	mgx.Must(err)
+	mounts, err := getKindMounts()
+	mgx.Must(err)
+	var registryCA string
+	if useRegistryTLS() {
+		certsDir, err := ensureRegistryCerts()
+		mgx.Must(err)
+		mounts = append(mounts, kindMount{HostPath: certsDir, ContainerPath: nodeRegistryCertsDir, ReadOnly: true})
+		registryCA = path.Join(nodeRegistryCertsDir, "ca.crt")
+	}
+	audit, auditMounts, err := getKindAudit()
+	mgx.Must(err)
+	kubeletArgs, err := getKubeletArgs()
+	mgx.Must(err)
+	cni, err := getKindCNI()
+	mgx.Must(err)
+
+	kindCfgData := kindConfig{
+		RegistryPort:       getRegistryPort(),
+		RegistryCA:         registryCA,
+		RegistryMirror:     mirror,
+		Workers:            make([]int, workers),
+		Mounts:             mounts,
+		ControlPlaneMounts: append(append([]kindMount{}, mounts...), auditMounts...),
+		Audit:              audit,
+		KubeletArgs:        kubeletArgs,
+		DisableDefaultCNI:  cni != defaultKindCNI,
+	}
+	if cni == "calico" {
+		kindCfgData.PodSubnet = calicoPodSubnet
+	}
+	kindCfgContents, err := renderKindConfig("hack/kind.config.yaml", kindCfgData)
+	mgx.Must(err)
+
+	err = ioutil.WriteFile("kind.config.yaml", kindCfgContents, 0644)
+	mgx.Must(errors.Wrap(err, "could not write kind config file"))
+	defer os.Remove("kind.config.yaml")
+
+	nodeImage, err := getKindNodeImage()
+	mgx.Must(err)
+
+	var imageFlag string
+	if nodeImage != "" {
+		kindLog.Printf("Using node image: %s", nodeImage)
+		imageFlag = "--image=" + nodeImage
+	}
+	must.Command("kind", "create", "cluster", "--name", getClusterName(), "--config", "kind.config.yaml", imageFlag).
+		CollapseArgs().Run()
+	recordClusterVersions()
+	if cni == "calico" {
+		installCalico()
+	}
+	if audit != nil {
+		kindLog.Printf("The api server audit log is written to %s", filepath.Join(auditLogsDir, filepath.Base(audit.LogPath)))
+	}
+
+	// Connect the kind and registry containers on the same network
+	network, err := getKindNetwork()
+	mgx.Must(err)
+	mgx.Must(connectToDockerNetwork(registryContainer, network))
+
+	// Document the local registry
+	registryCfg, err := ioutil.ReadFile("hack/local-registry.yaml")
+	mgx.Must(errors.Wrap(err, "error reading hack/local-registry.yaml"))
+
+	registryCfgTmpl, err := template.New("local-registry.yaml").Parse(string(registryCfg))
+	mgx.Must(errors.Wrap(err, "error parsing the local registry template hack/local-registry.yaml"))
+
+	var registryCfgContents bytes.Buffer
+	err = registryCfgTmpl.Execute(&registryCfgContents, kindCfgData)
+	mgx.Must(errors.Wrap(err, "error rendering the local registry template hack/local-registry.yaml"))
+	kubectl("apply", "-f", "-").Stdin(&registryCfgContents).Run()
+}
+
+// getKindCNI returns the CNI of the KIND cluster, set with PORTER_KIND_CNI,
+// either kindnet, the kind default, or calico.
+func getKindCNI() (string, error) {
+	cni := getEnvOrDefault("PORTER_KIND_CNI", defaultKindCNI)
+	switch cni {
+	case defaultKindCNI, "calico":
+		return cni, nil
+	default:
+		return "", errors.Errorf("invalid PORTER_KIND_CNI %q, expected kindnet or calico", cni)
+	}
+}
+
+// installCalico installs the Calico CNI in the current cluster, and waits
+// for it, and the nodes, to be ready. The nodes aren't ready until a CNI is
+// installed when the default CNI is disabled.
+func installCalico() {
+	kindLog.Printf("Installing Calico %s", calicoVersion)
+	minor := calicoVersion[:strings.LastIndex(calicoVersion, ".")]
+	kubectl("apply", "-f", fmt.Sprintf("https://docs.projectcalico.org/archive/%s/manifests/calico.yaml", minor)).Run()
+
+	kubectl("rollout", "status", "daemonset/calico-node", "-n", "kube-system", fmt.Sprintf("--timeout=%s", deployTimeout)).Run()
+	mgx.Must(waitForDeployment("kube-system", "calico-kube-controllers", deployTimeout))
+	kubectl("wait", "--for=condition=Ready", "nodes", "--all", fmt.Sprintf("--timeout=%s", deployTimeout)).Run()
+}
+
+// getKindWorkers returns the number of worker nodes to create in addition to
+// the control plane, set with PORTER_KIND_WORKERS.
+func getKindWorkers() (int, error) {
+	value := os.Getenv("PORTER_KIND_WORKERS")
+	if value == "" {
+		return 0, nil
+	}
+
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 0 {
+		return 0, errors.Errorf("invalid PORTER_KIND_WORKERS %q, expected a number of worker nodes", value)
+	}
+	return workers, nil
+}
+
+// kindConfig is the data used to render the kind cluster configuration
+// template, hack/kind.config.yaml.
+type kindConfig struct {
+	RegistryPort string
+	// RegistryCA is the path in the nodes to the CA of the local registry, when it uses TLS
+	RegistryCA string
+	// RegistryMirror is a pull-through cache for Docker Hub, if any
+	RegistryMirror string
+	// Workers has an entry for each worker node
+	Workers []int
+	// Mounts are host directories mounted into every node
+	Mounts []kindMount
+	// ControlPlaneMounts are mounted into the control plane node
+	ControlPlaneMounts []kindMount
+	// Audit configures audit logging on the api server, when enabled
+	Audit *kindAudit
+	// KubeletArgs are extra flags for the kubelet on every node
+	KubeletArgs map[string]string
+	// DisableDefaultCNI skips installing kindnet, so that another CNI can be installed
+	DisableDefaultCNI bool
+	// PodSubnet is the pod network of the cluster, when it isn't the kind default
+	PodSubnet string
+}
+
+// renderKindConfig renders the kind cluster configuration template.
+func renderKindConfig(templateFile string, data kindConfig) ([]byte, error) {
+	contents, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", templateFile)
+	}
+
+	tmpl, err := template.New(filepath.Base(templateFile)).Parse(string(contents))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing Kind config template %s", templateFile)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, errors.Wrapf(err, "error rendering Kind config template %s", templateFile)
+	}
+	return rendered.Bytes(), nil
+}
+
+// kindMount is a host directory that is mounted into the KIND nodes.
+type kindMount struct {
+	HostPath      string
+	ContainerPath string
+	ReadOnly      bool
+}
+
+// kindAudit has the locations, on the control plane node, of the api server
+// audit policy and log.
+type kindAudit struct {
+	PolicyPath string
+	LogDir     string
+	LogPath    string
+}
+
+// getKubeletArgs returns the kubelet flags that reserve resources on the
+// KIND nodes, from PORTER_KIND_SYSTEM_RESERVED, PORTER_KIND_KUBE_RESERVED and
+// PORTER_KIND_EVICTION_HARD.
+func getKubeletArgs() (map[string]string, error) {
+	flags := []struct{ env, flag, example string }{
+		{"PORTER_KIND_SYSTEM_RESERVED", "system-reserved", "memory=512Mi,cpu=250m"},
+		{"PORTER_KIND_KUBE_RESERVED", "kube-reserved", "memory=512Mi,cpu=250m"},
+		{"PORTER_KIND_EVICTION_HARD", "eviction-hard", "memory.available<256Mi"},
+	}
+
+	args := make(map[string]string)
+	for _, f := range flags {
+		value := strings.TrimSpace(os.Getenv(f.env))
+		if value == "" {
+			continue
+		}
+		for _, resource := range strings.Split(value, ",") {
+			if !strings.ContainsAny(resource, "=<") {
+				return nil, errors.Errorf("invalid %s %q, expected a list of resources such as %s", f.env, value, f.example)
+			}
+		}
+		args[f.flag] = value
+	}
+
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, nil
+}
+
+// getKindAudit returns the audit logging configuration for the control plane
+// when PORTER_KIND_AUDIT=true, along with the mounts that make the policy in
+// hack/audit-policy.yaml available to the node and write the log to the
+// audit-logs directory. Otherwise nil is returned.
+func getKindAudit() (*kindAudit, []kindMount, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("PORTER_KIND_AUDIT")); !enabled {
+		return nil, nil, nil
+	}
+
+	policyPath, err := filepath.Abs("hack/audit-policy.yaml")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not resolve the audit policy hack/audit-policy.yaml")
+	}
+	logDir, err := filepath.Abs(auditLogsDir)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not resolve the audit log directory %s", auditLogsDir)
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, nil, errors.Wrapf(err, "could not create the audit log directory %s", logDir)
+	}
+
+	audit := &kindAudit{
+		PolicyPath: "/etc/kubernetes/audit-policy.yaml",
+		LogDir:     "/var/log/kubernetes/audit",
+		LogPath:    "/var/log/kubernetes/audit/audit.log",
+	}
+	mounts := []kindMount{
+		{HostPath: policyPath, ContainerPath: audit.PolicyPath, ReadOnly: true},
+		{HostPath: logDir, ContainerPath: audit.LogDir},
+	}
+	return audit, mounts, nil
+}
+
+// getKindMounts parses the directories to mount into the KIND nodes from
+// PORTER_KIND_MOUNTS, and checks that the host directories exist.
+func getKindMounts() ([]kindMount, error) {
+	value := os.Getenv("PORTER_KIND_MOUNTS")
+	if value == "" {
+		return nil, nil
+	}
+
+	var mounts []kindMount
+	for _, pair := range strings.Split(value, ",") {
+		// Split on the last colon, which allows for Windows drive letters in the host path
+		pair = strings.TrimSpace(pair)
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, errors.Errorf("invalid mount %q in PORTER_KIND_MOUNTS, expected HOST_PATH:CONTAINER_PATH", pair)
+		}
+
+		hostPath, containerPath := pair[:i], pair[i+1:]
+		if !strings.HasPrefix(containerPath, "/") {
+			return nil, errors.Errorf("invalid mount %q in PORTER_KIND_MOUNTS, the container path must be absolute", pair)
+		}
+
+		hostPath, err := filepath.Abs(hostPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not resolve the host path of mount %q in PORTER_KIND_MOUNTS", pair)
+		}
+		if _, err := os.Stat(hostPath); err != nil {
+			return nil, errors.Errorf("the host path %s of mount %q in PORTER_KIND_MOUNTS does not exist", hostPath, pair)
+		}
+
+		mounts = append(mounts, kindMount{HostPath: hostPath, ContainerPath: containerPath})
+	}
+	return mounts, nil
+}
+
+// getRegistryMirror returns the url of a Docker Hub mirror, such as a
+// pull-through cache, that the KIND nodes should pull images from, set with
+// PORTER_REGISTRY_MIRROR. The nodes fall back to Docker Hub when the mirror
+// is unavailable.
+func getRegistryMirror() (string, error) {
+	mirror := os.Getenv("PORTER_REGISTRY_MIRROR")
+	if mirror == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(mirror)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.Errorf("invalid PORTER_REGISTRY_MIRROR %q, expected a url such as http://mirror.example.com:5000", mirror)
+	}
+	return mirror, nil
+}
+
+// getKindNodeImage returns the node image for the Kubernetes version requested
+// with PORTER_K8S_VERSION, e.g. 1.19 or v1.19.7, or an empty string to use
+// the KIND default.
+func getKindNodeImage() (string, error) {
+	version := strings.TrimPrefix(os.Getenv("PORTER_K8S_VERSION"), "v")
+	if version == "" {
+		return "", nil
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) >= 2 {
+		if image, ok := kindNodeImages[parts[0]+"."+parts[1]]; ok {
+			// When a patch version is specified, it must match the published image
+			if len(parts) == 2 || strings.Contains(image, ":v"+version+"@") {
+				return image, nil
+			}
+		}
+	}
+
+	supported := make([]string, 0, len(kindNodeImages))
+	for _, image := range kindNodeImages {
+		tag := strings.SplitN(strings.SplitN(image, ":", 2)[1], "@", 2)[0]
+		supported = append(supported, tag)
+	}
+	sort.Strings(supported)
+	return "", errors.Errorf("unsupported PORTER_K8S_VERSION %s, kind %s supports: %s", version, getKindVersion(), strings.Join(supported, ", "))
+}
+
+func configureCluster() {
+	mg.Deps(StartDockerRegistry, EnsureFlux)
+
+	// Don't change the namespace of a cluster that we didn't create
+	if useExistingCluster() {
+		for _, namespace := range []string{getOperatorNamespace(), fluxNamespace} {
+			if err := kubectl("get", "namespace", namespace).Must(false).RunS(); err != nil {
+				kindLog.Printf("Creating the %s namespace", namespace)
+				kubectl("create", "namespace", namespace).Run()
+			}
+		}
+	} else {
+		setClusterNamespace(getOperatorNamespace())
+	}
+
+	err := flux("check", "--pre").Must(false).RunV()
+	mgx.Must(errors.Wrap(err, "the cluster does not meet the flux prerequisites"))
+
+	flux("install", "--version="+getFluxVersion(), "--components="+getFluxComponents()).RunV()
+
+	// Wait for the controllers so that tests don't start before their webhooks and APIs are available
+	for _, component := range strings.Split(getFluxComponents(), ",") {
+		mgx.Must(waitForDeployment(fluxNamespace, strings.TrimSpace(component), deployTimeout))
+	}
+	mgx.Must(checkFlux())
+}
+
+// Stream the events of the flux resources in the test cluster.
+func FluxEvents() {
+	mg.Deps(EnsureKubectl, EnsureFlux)
+
+	if !useCluster() {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage EnsureCluster`", getClusterName()))
+	}
+
+	fluxLog.Printf("Watching the flux events, press Ctrl+C to stop")
+	cmd := getFluxEventsCommand(true, os.Stdout)
+	mgx.Must(errors.Wrap(runUntilInterrupted(cmd), "could not watch the flux events"))
+}
+
+// saveFluxEvents writes the current events of the flux resources to a file.
+func saveFluxEvents(file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		fluxLog.Printf("Could not create %s: %s", file, err)
+		return
+	}
+	defer f.Close()
+
+	if _, _, err := getFluxEventsCommand(false, f).Stderr(f).Exec(); err != nil {
+		fmt.Fprintf(f, "\n%s\n", err)
+	}
+}
+
+// getFluxEventsCommand builds the command that lists the events of the flux
+// resources in all namespaces, writing them to out.
+func getFluxEventsCommand(watch bool, out io.Writer) shx.PreparedCommand {
+	if fluxHasEventsCommand() {
+		args := []string{"events", "--all-namespaces"}
+		if watch {
+			args = append(args, "--watch")
+		}
+		return flux(args...).Must(false).Stdout(out)
+	}
+
+	args := []string{"get", "events", "--all-namespaces", "-o", fluxEventColumns}
+	if watch {
+		args = append(args, "--watch")
+	} else {
+		args = append(args, "--sort-by=.lastTimestamp")
+	}
+
+	// Keep the header, and the events reported by the flux controllers
+	components := strings.Split(getFluxComponents(), ",")
+	header := true
+	filter := &lineFilter{out: out, match: func(line string) bool {
+		if header {
+			header = false
+			return true
+		}
+		fields := strings.Fields(line)
+		for _, component := range components {
+			for _, field := range fields {
+				if field == component {
+					return true
+				}
+			}
+		}
+		return false
+	}}
+	return kubectl(args...).Must(false).Stdout(filter)
+}
+
+// fluxHasEventsCommand determines if the installed flux CLI has the events
+// command, which was added in flux v0.32.
+func fluxHasEventsCommand() bool {
+	// Prints, e.g. flux version 0.7.0
+	out, err := flux("--version").Must(false).OutputS()
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(fields[len(fields)-1], "v"), ".")
+	if len(parts) < 2 {
+		return false
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return major > 0 || minor >= 32
+}
+
+// lineFilter is a writer that only writes the lines that match to out.
+type lineFilter struct {
+	out     io.Writer
+	match   func(line string) bool
+	partial []byte
+}
+
+func (f *lineFilter) Write(p []byte) (int, error) {
+	f.partial = append(f.partial, p...)
+	for {
+		i := bytes.IndexByte(f.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		line := f.partial[:i+1]
+		if f.match(string(line)) {
+			if _, err := f.out.Write(line); err != nil {
+				return 0, err
+			}
+		}
+		f.partial = f.partial[i+1:]
+	}
+}
+
+// Check that flux is installed and healthy in the test cluster.
+func FluxCheck() {
+	mg.Deps(EnsureKubectl, EnsureFlux)
+
+	if !useCluster() {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage EnsureCluster`", getClusterName()))
+	}
+	mgx.Must(checkFlux())
+}
+
+// checkFlux runs the flux checks for the installed controllers.
+func checkFlux() error {
+	err := flux("check", "--components="+getFluxComponents()).Must(false).RunV()
+	return errors.Wrap(err, "flux is not healthy, see the failed checks above")
+}
+
+// Point flux at a git repository of porter manifests, for testing the GitOps workflow.
+func BootstrapFlux() {
+	mg.Deps(EnsureCluster)
+
+	repo := os.Getenv("PORTER_GITOPS_REPO")
+	if repo == "" {
+		mgx.Must(errors.New("PORTER_GITOPS_REPO must be set to the url of a git repository containing porter manifests"))
+	}
+	branch := getEnvOrDefault("PORTER_GITOPS_BRANCH", "main")
+	manifestsPath := getEnvOrDefault("PORTER_GITOPS_PATH", "./")
+
+	fluxLog.Printf("Configuring flux to sync %s from %s@%s", manifestsPath, repo, branch)
+	flux("create", "source", "git", gitopsName, "--namespace", fluxNamespace,
+		"--url", repo, "--branch", branch, "--interval=1m").RunV()
+
+	// flux create waits for the Kustomization to be reconciled before returning
+	flux("create", "kustomization", gitopsName, "--namespace", fluxNamespace,
+		"--source", gitopsName, "--path", manifestsPath, "--prune=true", "--interval=1m").RunV()
+
+	flux("get", "kustomizations", gitopsName, "--namespace", fluxNamespace).RunV()
+}
+
+// Trigger flux to immediately sync the GitOps repository.
+func FluxReconcile() {
+	mg.Deps(EnsureKubectl, EnsureFlux)
+
+	if !useCluster() {
+		mgx.Must(errors.Errorf("the %s kind cluster does not exist, create it with `mage EnsureCluster`", getClusterName()))
+	}
+
+	source := getEnvOrDefault("PORTER_FLUX_SOURCE", gitopsName)
+	kustomization := getEnvOrDefault("PORTER_FLUX_KUSTOMIZATION", gitopsName)
+
+	for _, r := range []struct{ kind, name string }{{"gitrepository", source}, {"kustomization", kustomization}} {
+		err := kubectl("get", r.kind, r.name, "-n", fluxNamespace).Must(false).RunS()
+		if err != nil {
+			mgx.Must(errors.Errorf("the %s %s does not exist in the %s namespace, create it with `mage BootstrapFlux`", r.kind, r.name, fluxNamespace))
+		}
+	}
+
+	flux("reconcile", "source", "git", source, "--namespace", fluxNamespace).RunV()
+	flux("reconcile", "kustomization", kustomization, "--namespace", fluxNamespace).RunV()
+}
+
+// Remove flux from the test cluster, leaving the cluster and the operator installed.
+func UninstallFlux() {
+	mg.Deps(EnsureKubectl, EnsureFlux)
+
+	if !useCluster() {
+		fluxLog.Printf("The test cluster does not exist, so there is nothing to uninstall")
+		return
+	}
+	requireKindContext()
+
+	if !isFluxInstalled() {
+		fluxLog.Printf("Flux is not installed")
+		return
+	}
+
+	fluxLog.Printf("Uninstalling flux")
+	flux("uninstall", "--silent", "--namespace", fluxNamespace).Must(false).RunV()
+
+	deadline := time.Now().Add(undeployTimeout)
+	for isFluxInstalled() {
+		if time.Now().After(deadline) {
+			// Custom resources whose finalizers can't complete now that the
+			// controllers are gone block deleting the CRDs and the namespace
+			fluxLog.Printf("Timed out waiting for flux to be removed, removing finalizers")
+			crds, _ := kubectl("get", "crds", "-l", fluxCRDSelector, "-o", `jsonpath={range .items[*]}{.metadata.name}{"\n"}{end}`).
+				Must(false).OutputS()
+			for _, crd := range strings.Fields(crds) {
+				removeCRDFinalizers(crd)
+			}
+			kubectl("delete", "crds", "-l", fluxCRDSelector, "--ignore-not-found", fmt.Sprintf("--timeout=%s", undeployTimeout)).Run()
+			kubectl("delete", "namespace", fluxNamespace, "--ignore-not-found", fmt.Sprintf("--timeout=%s", undeployTimeout)).Run()
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+	fluxLog.Printf("Flux was uninstalled")
+}
+
+// isFluxInstalled determines if any part of flux is in the current cluster,
+// either its namespace or its CRDs.
+func isFluxInstalled() bool {
+	if err := kubectl("get", "namespace", fluxNamespace).Must(false).RunS(); err == nil {
+		return true
+	}
+	crds, _ := kubectl("get", "crds", "-l", fluxCRDSelector, "-o", "name").Must(false).OutputS()
+	return crds != ""
+}
+
+// getFluxVersion returns the version of flux to install.
+func getFluxVersion() string {
+	return getEnvOrDefault("PORTER_FLUX_VERSION", fluxVersion)
+}
+
+// getFluxComponents returns a comma separated list of the flux controllers to install.
+func getFluxComponents() string {
+	return getEnvOrDefault("PORTER_FLUX_COMPONENTS", fluxComponents)
+}
+
+// Delete the KIND cluster, named porter by default, and its kubeconfig.
+func DeleteKindCluster() {
+	if useExistingCluster() {
+		mgx.Must(errors.New("refusing to delete the cluster because PORTER_USE_EXISTING_CLUSTER is set, it may not be a kind cluster"))
+	}
+	mg.Deps(EnsureKind)
+
+	// Find the network before the cluster is deleted, to disconnect the registry from it
+	network, err := getKindNetwork()
+	if err != nil {
+		network = defaultKindNetwork
+	}
+
+	must.RunE("kind", "delete", "cluster", "--name", getClusterName())
+
+	// Every kind cluster is on the same network, so keep the registry connected
+	// while any of them, e.g. the dev cluster during TestE2E, are still using it
+	clusters, err := shx.OutputE("kind", "get", "clusters")
+	if err == nil && clusters == "" && isOnDockerNetwork(registryContainer, network) {
+		must.RunE("docker", "network", "disconnect", network, registryContainer)
+	}
+
+	// Don't leave a KUBECONFIG behind that points to a cluster that is gone
+	err = os.Remove(getKubeconfig())
+	if err != nil && !os.IsNotExist(err) {
+		mgx.Must(errors.Wrapf(err, "could not remove %s", getKubeconfig()))
+	}
+
+	if stopRegistry, _ := strconv.ParseBool(os.Getenv("PORTER_STOP_REGISTRY")); stopRegistry {
+		StopDockerRegistry()
+	}
+}
+
+// Delete the kind cluster, the local registry and its data, and build artifacts.
+func PurgeAll() {
+	mg.SerialDeps(DeleteKindCluster, PurgeRegistry)
+
+	for _, path := range []string{getKubeconfig(), "kind.config.yaml", "bin"} {
+		if err := os.RemoveAll(path); err != nil {
+			mgx.Must(errors.Wrapf(err, "could not remove %s", path))
+		}
+	}
+}
+
+// getKindNetwork returns the docker network of the kind cluster, from its
+// control plane container. This is usually named kind, but can be changed,
+// e.g. with KIND_EXPERIMENTAL_DOCKER_NETWORK.
+func getKindNetwork() (string, error) {
+	controlPlane := getClusterName() + "-control-plane"
+	networks, err := shx.OutputS("docker", "inspect", controlPlane, "-f",
+		`{{range $name, $settings := .NetworkSettings.Networks}}{{$name}}{{"\n"}}{{end}}`)
+	if err != nil {
+		return "", errors.Errorf("could not inspect the %s container to find the kind network", controlPlane)
+	}
+
+	names := strings.Fields(networks)
+	if len(names) == 0 {
+		return "", errors.Errorf("the %s container is not connected to a network", controlPlane)
+	}
+	for _, name := range names {
+		if name == defaultKindNetwork {
+			return name, nil
+		}
+	}
+	return names[0], nil
+}
+
+// connectToDockerNetwork connects a container to a network, retrying because
+// a network that was just created is not always immediately available.
+func connectToDockerNetwork(container string, network string) error {
+	const attempts = 5
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if isOnDockerNetwork(container, network) {
+			return nil
+		}
+
+		var output bytes.Buffer
+		_, _, err = shx.Command("docker", "network", "connect", network, container).
+			Stdout(&output).Stderr(&output).Exec()
+		if err == nil || strings.Contains(output.String(), "already exists") {
+			return nil
+		}
+		err = errors.Wrap(err, strings.TrimSpace(output.String()))
+
+		if i < attempts {
+			backoff := time.Duration(i) * time.Second
+			kindLog.Debugf("Could not connect %s to the %s network, retrying in %s", container, network, backoff)
+			time.Sleep(backoff)
+		}
+	}
+	return errors.Wrapf(err, "could not connect %s to the %s network", container, network)
+}
+
+func isOnDockerNetwork(container string, network string) bool {
+	networkId, err := shx.OutputS("docker", "network", "inspect", network, "-f", "{{.Id}}")
+	if err != nil || networkId == "" {
+		return false
+	}
+
+	networks, err := shx.OutputS("docker", "inspect", container, "-f",
+		`{{range $name, $settings := .NetworkSettings.Networks}}{{$name}} {{$settings.NetworkID}}{{"\n"}}{{end}}`)
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(networks, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[0] == network || fields[1] == networkId) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure kind is installed, and is the pinned version.
+func EnsureKind() {
+	version := getKindVersion()
+	if isCommandCurrent("kind", version, "version") {
+		return
+	}
+	if installFromToolsDir("kind") {
+		return
+	}
+
+	kindURL := withToolArch("kind", "https://github.com/kubernetes-sigs/kind/releases/download/{{.VERSION}}/kind-{{.GOOS}}-{{.GOARCH}}")
+	mgx.Must(downloadAndVerify(kindURL, kindURL+".sha256sum", "kind", version))
+	warnIfShadowed("kind")
+}
+
+// Ensure kubectl is installed, and is the pinned version.
+func EnsureKubectl() {
+	version, err := getKubectlVersion()
+	mgx.Must(err)
+
+	if isCommandCurrent("kubectl", version, "version", "--client") {
+		return
+	}
+	if installFromToolsDir("kubectl") {
+		return
+	}
+
+	kubectlURL := withToolArch("kubectl", "https://storage.googleapis.com/kubernetes-release/release/{{.VERSION}}/bin/{{.GOOS}}/{{.GOARCH}}/kubectl{{.EXT}}")
+	mgx.Must(downloadAndVerify(kubectlURL, kubectlURL+".sha256", "kubectl", version))
+	warnIfShadowed("kubectl")
+}
+
+// getKubectlVersion returns the version of kubectl to install, looking up
+// the latest release when PORTER_KUBECTL_VERSION is stable. The lookup is
+// retried with a backoff, so that a network blip doesn't fail the build.
+func getKubectlVersion() (string, error) {
+	version := getEnvOrDefault("PORTER_KUBECTL_VERSION", kubectlVersion)
+	if version != "stable" {
+		return version, nil
+	}
+
+	const versionURL = "https://storage.googleapis.com/kubernetes-release/release/stable.txt"
+	const attempts = 4
+	var err error
+	for i := 1; i <= attempts; i++ {
+		var latest string
+		if latest, err = getStableKubectlVersion(versionURL); err == nil {
+			return latest, nil
+		}
+
+		if i < attempts {
+			backoff := time.Duration(1<<uint(i-1)) * time.Second
+			toolsLog.Debugf("Could not get %s, retrying in %s: %s", versionURL, backoff, err)
+			time.Sleep(backoff)
+		}
+	}
+	return "", errors.Wrapf(err, "unable to determine the latest version of kubectl after %d attempts", attempts)
+}
+
+// getStableKubectlVersion requests the latest kubectl version from stable.txt once.
+func getStableKubectlVersion(versionURL string) (string, error) {
+	// Unlike the downloads, this small request shouldn't take long, so don't wait forever
+	client := &http.Client{Transport: httpClient.Transport, Timeout: 15 * time.Second}
+	versionResp, err := client.Get(versionURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "GET %s", versionURL)
+	}
+	defer versionResp.Body.Close()
+
+	if versionResp.StatusCode > 299 {
+		return "", errors.Errorf("GET %s: %s", versionURL, versionResp.Status)
+	}
+
+	latest, err := ioutil.ReadAll(versionResp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading response from %s", versionURL)
+	}
+	version := strings.TrimSpace(string(latest))
+	if version == "" {
+		return "", errors.Errorf("GET %s: the response did not have a version", versionURL)
+	}
+	return version, nil
+}
+
+func kubectl(args ...string) shx.PreparedCommand {
+	kubeconfig := fmt.Sprintf("KUBECONFIG=%s", os.Getenv("KUBECONFIG"))
+	return must.Command("kubectl", args...).Env(kubeconfig)
+}
+
+func flux(args ...string) shx.PreparedCommand {
+	kubeconfig := fmt.Sprintf("KUBECONFIG=%s", os.Getenv("KUBECONFIG"))
+	return must.Command("flux", args...).Env(kubeconfig)
+}
+
+func kustomize(args ...string) shx.PreparedCommand {
+	return must.Command("kustomize", args...)
+}
+
+// Ensure yq is installed.
+func EnsureYq() {
+	if ok, _ := pkg.IsCommandAvailable("yq", ""); !ok && installFromToolsDir("yq") {
+		return
+	}
+	mgx.Must(pkg.EnsurePackage("github.com/mikefarah/yq/v4", "", ""))
+}
+
+// Ensure ginkgo is installed.
+func EnsureGinkgo() {
+	version := strings.TrimPrefix(ginkgoVersion, "v")
+	if ok, _ := pkg.IsCommandAvailable("ginkgo", version, "version"); !ok && installFromToolsDir("ginkgo") {
+		return
+	}
+	mgx.Must(pkg.EnsurePackage("github.com/onsi/ginkgo/v2/ginkgo", version, "version"))
+}
+
+// Ensure kustomize is installed.
+func EnsureKustomize() {
+	if ok, _ := pkg.IsCommandAvailable("kustomize", ""); ok {
+		return
+	}
+	if installFromToolsDir("kustomize") {
+		return
+	}
+
+	// The release tag is prefixed with kustomize/, which must be escaped in the url
+	kustomizeURL := withToolArch("kustomize", "https://github.com/kubernetes-sigs/kustomize/releases/download/kustomize%2F{{.VERSION}}/kustomize_{{.VERSION}}_{{.GOOS}}_{{.GOARCH}}.tar.gz")
+	mgx.Must(downloadTarballToGopathBin(kustomizeURL, "kustomize{{.EXT}}", "", "kustomize", kustomizeVersion))
+
+	err := shx.RunE("kustomize", "version")
+	mgx.Must(errors.Wrap(err, "kustomize was installed but could not be run"))
+}
+
+// Ensure the flux CLI is installed, and is the same version as the flux controllers.
+func EnsureFlux() {
+	// The release tag has a v prefix but the file names, and flux --version, do not
+	version := strings.TrimPrefix(getFluxVersion(), "v")
+	if isCommandCurrent("flux", version, "--version") {
+		return
+	}
+	if installFromToolsDir("flux") {
+		return
+	}
+
+	fluxURL := withToolArch("flux", "https://github.com/fluxcd/flux2/releases/download/v{{.VERSION}}/flux_{{.VERSION}}_{{.GOOS}}_{{.GOARCH}}.tar.gz")
+	fluxChecksums := "https://github.com/fluxcd/flux2/releases/download/v{{.VERSION}}/flux_{{.VERSION}}_checksums.txt"
+	mgx.Must(downloadTarballToGopathBin(fluxURL, "flux{{.EXT}}", fluxChecksums, "flux", version))
+	warnIfShadowed("flux")
+}
+
+// Ensure helm is installed.
+func EnsureHelm() {
+	if ok, _ := pkg.IsCommandAvailable("helm", ""); ok {
+		return
+	}
+	if installFromToolsDir("helm") {
+		return
+	}
+
+	// The binary is nested in a platform specific directory, e.g. linux-amd64/helm
+	helmURL := withToolArch("helm", "https://get.helm.sh/helm-{{.VERSION}}-{{.GOOS}}-{{.GOARCH}}.tar.gz")
+	helmEntry := withToolArch("helm", "{{.GOOS}}-{{.GOARCH}}/helm{{.EXT}}")
+	mgx.Must(downloadTarballToGopathBin(helmURL, helmEntry, helmURL+".sha256sum", "helm", helmVersion))
+}
+
+// Ensure delve is installed.
+func EnsureDelve() {
+	if ok, _ := pkg.IsCommandAvailable("dlv", ""); !ok && installFromToolsDir("dlv") {
+		return
+	}
+	mgx.Must(pkg.EnsurePackage("github.com/go-delve/delve/cmd/dlv", "", ""))
+}
+
+// Ensure porter is installed, along with the exec mixin.
+func EnsurePorter() {
+	if ok, _ := pkg.IsCommandAvailable("porter", ""); ok {
+		return
+	}
+	if !installFromToolsDir("porter") {
+		porterURL := withToolArch("porter", "https://cdn.porter.sh/{{.VERSION}}/porter-{{.GOOS}}-{{.GOARCH}}{{.EXT}}")
+		mgx.Must(downloadToGopathBin(porterURL, "porter", porterVersion))
+	}
+
+	// Bundles are always run on linux, so porter needs the linux binary
+	// in its home directory to build the bundle's invocation image
+	porterHome := os.Getenv("PORTER_HOME")
+	if porterHome == "" {
+		home, err := os.UserHomeDir()
+		mgx.Must(errors.Wrap(err, "could not determine the home directory"))
+		porterHome = filepath.Join(home, ".porter")
+	}
+	runtimesDir := filepath.Join(porterHome, "runtimes")
+	mgx.Must(os.MkdirAll(runtimesDir, 0755))
+
+	runtimePath := filepath.Join(runtimesDir, "porter-runtime")
+	if toolsDir := os.Getenv("PORTER_TOOLS_DIR"); toolsDir != "" {
+		src := filepath.Join(toolsDir, "porter-runtime")
+		f, err := os.Open(src)
+		mgx.Must(errors.Wrapf(err, "air-gapped mode: porter-runtime not found in PORTER_TOOLS_DIR %s", toolsDir))
+		defer f.Close()
+		mgx.Must(errors.Wrapf(writeExecutable(runtimePath, f, ""), "could not install %s", src))
+	} else {
+		runtimeURL := fmt.Sprintf("https://cdn.porter.sh/%s/porter-linux-amd64", porterVersion)
+		toolsLog.Printf("Downloading %s to %s", runtimeURL, runtimesDir)
+		mgx.Must(downloadExecutable(runtimeURL, runtimePath, ""))
+	}
+
+	must.RunV("porter", "mixin", "install", "exec", "--version", porterVersion)
+}
+
+// Ensure kubeconform is installed.
+func EnsureKubeconform() {
+	if ok, _ := pkg.IsCommandAvailable("kubeconform", ""); ok {
+		return
+	}
+	if installFromToolsDir("kubeconform") {
+		return
+	}
+
+	kubeconformURL := withToolArch("kubeconform", "https://github.com/yannh/kubeconform/releases/download/{{.VERSION}}/kubeconform-{{.GOOS}}-{{.GOARCH}}.tar.gz")
+	mgx.Must(downloadTarballToGopathBin(kubeconformURL, "kubeconform{{.EXT}}", "", "kubeconform", kubeconformVersion))
+}
+
+// Ensure staticcheck is installed.
+func EnsureStaticCheck() {
+	if ok, _ := pkg.IsCommandAvailable("staticcheck", staticcheckVersion, "-version"); !ok && installFromToolsDir("staticcheck") {
+		return
+	}
+	mgx.Must(pkg.EnsurePackage("honnef.co/go/tools/cmd/staticcheck", staticcheckVersion, "-version"))
+}
+
+// Ensure benchstat is installed.
+func EnsureBenchstat() {
+	if ok, _ := pkg.IsCommandAvailable("benchstat", ""); ok {
+		return
+	}
+	if installFromToolsDir("benchstat") {
+		return
+	}
+	mgx.Must(pkg.InstallPackage("golang.org/x/perf/cmd/benchstat", ""))
+}
+
+// Ensure gotestsum is installed.
+func EnsureGotestsum() {
+	if ok, _ := pkg.IsCommandAvailable("gotestsum", ""); ok {
+		return
+	}
+	if installFromToolsDir("gotestsum") {
+		return
+	}
+	mgx.Must(pkg.InstallPackage("gotest.tools/gotestsum", gotestsumVersion))
+}
+
+// Ensure controller-gen is installed.
+func EnsureControllerGen() {
+	if ok, _ := pkg.IsCommandAvailable("controller-gen", controllerGenVersion, "--version"); !ok && installFromToolsDir("controller-gen") {
+		return
+	}
+	mgx.Must(pkg.EnsurePackage("sigs.k8s.io/controller-tools/cmd/controller-gen", controllerGenVersion, "--version"))
+}
+
+// Ensure that a local docker registry is running.
+func StartDockerRegistry() {
+	if isContainerRunning(registryContainer) {
+		env, err := getContainerEnv(registryContainer)
+		mgx.Must(err)
+		if hasEnv(env, "REGISTRY_HTTP_TLS_CERTIFICATE") == useRegistryTLS() && hasEnv(env, "REGISTRY_AUTH") == useRegistryAuth() {
+			return
+		}
+		registryLog.Printf("Recreating the local docker registry to match PORTER_REGISTRY_TLS and PORTER_REGISTRY_AUTH")
+	}
+
+	StopDockerRegistry()
+
+	port := getRegistryPort()
+	mgx.Must(checkPortAvailable(port))
+
+	registryLog.Printf("Starting local docker registry")
+	// Images are kept in a volume across restarts, until PurgeRegistry removes it.
+	// Allow deleting images so that RegistryGC can remove old tags
+	args := []string{"run", "-d", "-p", port + ":5000", "--name", registryContainer,
+		"-v", registryVolume + ":/var/lib/registry", "-e", "REGISTRY_STORAGE_DELETE_ENABLED=true"}
+	if useRegistryTLS() {
+		certsDir, err := ensureRegistryCerts()
+		mgx.Must(err)
+		args = append(args, "-v", certsDir+":/certs:ro",
+			"-e", "REGISTRY_HTTP_TLS_CERTIFICATE=/certs/registry.crt",
+			"-e", "REGISTRY_HTTP_TLS_KEY=/certs/registry.key")
+	}
+	if useRegistryAuth() {
+		authDir, err := writeRegistryHtpasswd()
+		mgx.Must(err)
+		args = append(args, "-v", authDir+":/auth:ro",
+			"-e", "REGISTRY_AUTH=htpasswd",
+			"-e", "REGISTRY_AUTH_HTPASSWD_REALM=Registry Realm",
+			"-e", "REGISTRY_AUTH_HTPASSWD_PATH=/auth/htpasswd")
+	}
+	args = append(args, "registry:2")
+	must.RunE("docker", args...)
+
+	mgx.Must(waitForRegistry(port))
+
+	if useRegistryAuth() {
+		// Log in so that images can be pushed to the registry
+		username, password := getRegistryCredentials()
+		must.Command("docker", "login", "localhost:"+port, "--username", username, "--password-stdin").
+			Stdin(strings.NewReader(password)).RunE()
+	}
+}
+
+// checkPortAvailable returns an error explaining how to free up the port
+// for the local registry when something else is already listening on it.
+func checkPortAvailable(port string) error {
+	l, err := net.Listen("tcp", ":"+port)
+	if err == nil {
+		return l.Close()
+	}
+
+	msg := fmt.Sprintf("port %s is already in use, so the local registry can't listen on it. Stop whatever is using the port, or set PORTER_REGISTRY_PORT to use a different one", port)
+	if runtime.GOOS == "darwin" && port == "5000" {
+		msg += ". On macOS, the AirPlay Receiver uses port 5000, turn it off in System Preferences > Sharing"
+	}
+	return errors.Wrap(err, msg)
+}
+
+// hasEnv determines if an environment variable is set in a list of
+// NAME=VALUE pairs, such as the environment of a container.
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForRegistry polls the registry api until it responds successfully.
+func waitForRegistry(port string) error {
+	registryURL := fmt.Sprintf("%s://localhost:%s/v2/", getRegistryScheme(), port)
+	registryClient, err := getRegistryClient()
+	if err != nil {
+		return err
+	}
+	client := *registryClient
+	client.Timeout = 2 * time.Second
+
+	deadline := time.Now().Add(registryReadyTimeout)
+	for {
+		resp, err := client.Get(registryURL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = errors.Errorf("GET %s: %s", registryURL, resp.Status)
+			}
+			return errors.Wrapf(err, "the local registry was not ready after %s, check its logs with `docker logs %s`", registryReadyTimeout, registryContainer)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// useRegistryTLS determines if the local registry is served over https, set
+// with PORTER_REGISTRY_TLS=true.
+func useRegistryTLS() bool {
+	useTLS, _ := strconv.ParseBool(os.Getenv("PORTER_REGISTRY_TLS"))
+	return useTLS
+}
+
+// getRegistryScheme returns the url scheme of the local registry api.
+func getRegistryScheme() string {
+	if useRegistryTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// getRegistryClient returns an http client for the local registry api, which
+// trusts the registry CA when PORTER_REGISTRY_TLS=true, and authenticates
+// when PORTER_REGISTRY_AUTH=true.
+func getRegistryClient() (*http.Client, error) {
+	transport := httpClient.Transport.(*http.Transport).Clone()
+	if useRegistryTLS() {
+		caFile := filepath.Join(registryCertsDir, "ca.crt")
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the local registry CA %s, start the registry with `mage StartDockerRegistry`", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("%s does not contain a PEM encoded certificate", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if useRegistryAuth() {
+		username, password := getRegistryCredentials()
+		return &http.Client{Transport: basicAuthTransport{username: username, password: password, next: transport}}, nil
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// useRegistryAuth determines if the local registry requires a username and
+// password, set with PORTER_REGISTRY_AUTH=true.
+func useRegistryAuth() bool {
+	useAuth, _ := strconv.ParseBool(os.Getenv("PORTER_REGISTRY_AUTH"))
+	return useAuth
+}
+
+// getRegistryCredentials returns the username and password for the local
+// registry, set with PORTER_REGISTRY_USERNAME and PORTER_REGISTRY_PASSWORD.
+func getRegistryCredentials() (string, string) {
+	return getEnvOrDefault("PORTER_REGISTRY_USERNAME", defaultRegistryUsername),
+		getEnvOrDefault("PORTER_REGISTRY_PASSWORD", defaultRegistryPassword)
+}
+
+// writeRegistryHtpasswd writes the htpasswd file for the local registry
+// credentials to bin/registry-auth, and returns the absolute path to the
+// directory.
+func writeRegistryHtpasswd() (string, error) {
+	dir, err := filepath.Abs(registryAuthDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve the absolute path of %s", registryAuthDir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrapf(err, "could not create %s", dir)
+	}
+
+	// The registry only supports bcrypt hashed passwords
+	username, password := getRegistryCredentials()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "could not hash the local registry password")
+	}
+
+	htpasswdFile := filepath.Join(dir, "htpasswd")
+	err = ioutil.WriteFile(htpasswdFile, []byte(fmt.Sprintf("%s:%s\n", username, hash)), 0644)
+	return dir, errors.Wrapf(err, "could not write %s", htpasswdFile)
+}
+
+// createRegistryPullSecret creates an image pull secret for the local
+// registry in a namespace. The secret has credentials for both the
+// localhost address that images are tagged with, and the registry container
+// that the kind nodes pull from.
+func createRegistryPullSecret(namespace string) error {
+	username, password := getRegistryCredentials()
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	creds := map[string]string{"username": username, "password": password, "auth": auth}
+	dockerConfig, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			"localhost:" + getRegistryPort(): creds,
+			registryContainer + ":5000":      creds,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not encode the docker config for the pull secret")
+	}
+
+	secret, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]string{"name": registryPullSecret, "namespace": namespace},
+		"type":       "kubernetes.io/dockerconfigjson",
+		"data":       map[string]string{".dockerconfigjson": base64.StdEncoding.EncodeToString(dockerConfig)},
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not encode the pull secret")
+	}
+
+	registryLog.Printf("Creating the %s pull secret in the %s namespace", registryPullSecret, namespace)
+	err = kubectl("apply", "-f", "-").Must(false).Stdin(bytes.NewReader(secret)).RunE()
+	return errors.Wrapf(err, "could not create the %s pull secret in the %s namespace", registryPullSecret, namespace)
+}
+
+// basicAuthTransport adds basic authentication to every request.
+type basicAuthTransport struct {
+	username string
+	password string
+	next     http.RoundTripper
+}
+
+func (t basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return t.next.RoundTrip(req)
+}
+
+// ensureRegistryCerts generates the certificate for the local registry in
+// bin/registry-certs, using mkcert when it is installed so that the
+// certificate is trusted on the host, and otherwise a self-signed
+// certificate. The certificate of the CA that signed it is saved as ca.crt.
+// Returns the absolute path to the directory.
+func ensureRegistryCerts() (string, error) {
+	dir, err := filepath.Abs(registryCertsDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve the absolute path of %s", registryCertsDir)
+	}
+	certFile := filepath.Join(dir, "registry.crt")
+	keyFile := filepath.Join(dir, "registry.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	if isCertificateCurrent(certFile) {
+		if _, err := os.Stat(keyFile); err == nil {
+			if _, err := os.Stat(caFile); err == nil {
+				return dir, nil
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrapf(err, "could not create %s", dir)
+	}
+
+	if ok, _ := pkg.IsCommandAvailable("mkcert", ""); ok {
+		registryLog.Printf("Generating the local registry certificate with mkcert")
+		hosts := append([]string{"-cert-file", certFile, "-key-file", keyFile}, registryHosts...)
+		if err := shx.Command("mkcert", hosts...).RunE(); err != nil {
+			return "", errors.Wrap(err, "could not generate the local registry certificate with mkcert")
+		}
+
+		caRoot, err := shx.OutputE("mkcert", "-CAROOT")
+		if err != nil {
+			return "", errors.Wrap(err, "could not find the mkcert CA")
+		}
+		ca, err := ioutil.ReadFile(filepath.Join(strings.TrimSpace(caRoot), "rootCA.pem"))
+		if err != nil {
+			return "", errors.Wrap(err, "could not read the mkcert CA")
+		}
+		return dir, errors.Wrapf(ioutil.WriteFile(caFile, ca, 0644), "could not write %s", caFile)
+	}
+
+	registryLog.Printf("Generating a self-signed certificate for the local registry")
+	return dir, writeSelfSignedCertificate(certFile, keyFile, caFile)
+}
+
+// isCertificateCurrent determines if a PEM encoded certificate exists and is
+// valid for at least another day.
+func isCertificateCurrent(certFile string) bool {
+	contents, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(24 * time.Hour).Before(cert.NotAfter)
+}
+
+// writeSelfSignedCertificate generates a self-signed certificate for the
+// local registry hosts. The certificate is its own CA, so it is written to
+// caFile as well.
+func writeSelfSignedCertificate(certFile string, keyFile string, caFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "could not generate a private key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return errors.Wrap(err, "could not generate a serial number")
+	}
+
+	certTemplate := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Porter Operator Development"}, CommonName: registryContainer},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range registryHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			certTemplate.IPAddresses = append(certTemplate.IPAddresses, ip)
+		} else {
+			certTemplate.DNSNames = append(certTemplate.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &key.PublicKey, key)
+	if err != nil {
+		return errors.Wrap(err, "could not create the certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "could not encode the private key")
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return errors.Wrapf(err, "could not write %s", keyFile)
+	}
+	if err := ioutil.WriteFile(certFile, cert, 0644); err != nil {
+		return errors.Wrapf(err, "could not write %s", certFile)
+	}
+	return errors.Wrapf(ioutil.WriteFile(caFile, cert, 0644), "could not write %s", caFile)
+}
+
+// getContainerEnv returns the environment variables of a container.
+func getContainerEnv(name string) ([]string, error) {
+	out, err := shx.OutputE("docker", "container", "inspect", "-f", "{{range .Config.Env}}{{println .}}{{end}}", name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not inspect the %s container", name)
+	}
+	return strings.Split(strings.TrimSpace(out), "\n"), nil
+}
+
+// Stops the local docker registry.
+func StopDockerRegistry() {
+	if containerExists(registryContainer) {
+		registryLog.Printf("Stopping local docker registry")
+		removeContainer(registryContainer)
+	}
+}
+
+// Stops the local docker registry and deletes its stored images.
+func PurgeRegistry() {
+	StopDockerRegistry()
+
+	if err := shx.RunS("docker", "volume", "inspect", registryVolume); err != nil {
+		return
+	}
+
+	registryLog.Printf("Removing the local docker registry data")
+	must.RunE("docker", "volume", "rm", registryVolume)
+}
+
+// Stream the logs of the local docker registry.
+func RegistryLogs() {
+	if !containerExists(registryContainer) {
+		registryLog.Printf("The local docker registry is not running, start it with `mage StartDockerRegistry`")
+		return
+	}
+
+	logs := shx.Command("docker", "logs", "--tail=100", "--follow", registryContainer)
+	mgx.Must(errors.Wrap(runUntilInterrupted(logs), "docker logs stopped unexpectedly"))
+}
+
+// List the repositories and tags stored in the local docker registry.
+func RegistryCatalog() {
+	if !isContainerRunning(registryContainer) {
+		registryLog.Printf("The local docker registry is not running, start it with `mage StartDockerRegistry`")
+		return
+	}
+
+	registry := "localhost:" + getRegistryPort()
+	repositories, err := getRegistryRepositories(registry)
+	mgx.Must(err)
+	if len(repositories) == 0 {
+		fmt.Printf("%s is empty\n", registry)
+		return
+	}
+
+	for _, repository := range repositories {
+		fmt.Printf("%s/%s\n", registry, repository)
+		tags, err := getRegistryTags(registry + "/" + repository)
+		if err != nil {
+			fmt.Printf("  could not list the tags: %s\n", err)
+			continue
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			fmt.Printf("  %s\n", tag)
+		}
+	}
+}
+
+// Reclaim disk space used by the local docker registry for images that are no longer tagged.
+func RegistryGC() {
+	if !isContainerRunning(registryContainer) {
+		registryLog.Printf("The local docker registry is not running, start it with `mage StartDockerRegistry`")
+		return
+	}
+
+	if value := os.Getenv("PORTER_GC_KEEP_TAGS"); value != "" {
+		keep, err := strconv.Atoi(value)
+		if err != nil || keep < 1 {
+			mgx.Must(errors.Errorf("invalid PORTER_GC_KEEP_TAGS %q, expected the number of tags to keep", value))
+		}
+		mgx.Must(deleteOldRegistryTags("localhost:"+getRegistryPort(), keep))
+	}
+
+	before := getRegistryDiskUsage()
+
+	args := []string{"exec", registryContainer, "registry", "garbage-collect", "/etc/docker/registry/config.yml"}
+	help, _ := shx.Command("docker", "exec", registryContainer, "registry", "garbage-collect", "--help").Output()
+	if strings.Contains(help, "delete-untagged") {
+		args = append(args, "--delete-untagged")
+	}
+	registryLog.Printf("Garbage collecting the local docker registry")
+	must.RunE("docker", args...)
+
+	after := getRegistryDiskUsage()
+	if before >= 0 && after >= 0 {
+		registryLog.Printf("Freed %s, the registry is using %s", formatBytes(before-after), formatBytes(after))
+	}
+}
+
+// getRegistryDiskUsage returns the number of bytes stored by the local
+// registry, or -1 when it can't be determined.
+func getRegistryDiskUsage() int64 {
+	out, err := shx.OutputS("docker", "exec", registryContainer, "du", "-sk", "/var/lib/registry")
+	if err != nil {
+		return -1
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return -1
+	}
+	kb, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return kb * 1024
+}
+
+// registryImage is a tagged image in a registry.
+type registryImage struct {
+	tag     string
+	digest  string
+	created time.Time
+}
+
+// deleteOldRegistryTags deletes the images in each repository of a registry,
+// except for the most recently created tags.
+func deleteOldRegistryTags(registry string, keep int) error {
+	repositories, err := getRegistryRepositories(registry)
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range repositories {
+		tags, err := getRegistryTags(registry + "/" + repository)
+		if err != nil {
+			return err
+		}
+		if len(tags) <= keep {
+			continue
+		}
+
+		images := make([]registryImage, 0, len(tags))
+		for _, tag := range tags {
+			img, err := getRegistryImage(registry, repository, tag)
+			if err != nil {
+				return err
+			}
+			images = append(images, img)
+		}
+		sort.Slice(images, func(i, j int) bool {
+			return images[i].created.After(images[j].created)
+		})
+
+		// Deleting a manifest removes every tag that references it, so don't
+		// delete manifests that are still referenced by a tag that is kept
+		kept := make(map[string]bool)
+		for _, img := range images[:keep] {
+			kept[img.digest] = true
+		}
+		for _, img := range images[keep:] {
+			if kept[img.digest] {
+				continue
+			}
+			registryLog.Printf("Deleting %s/%s:%s", registry, repository, img.tag)
+			if err := deleteRegistryManifest(registry, repository, img.digest); err != nil {
+				return err
+			}
+			kept[img.digest] = true
+		}
+	}
+	return nil
+}
+
+// getRegistryImage looks up the manifest digest and creation time of a tagged image.
+func getRegistryImage(registry string, repository string, tag string) (registryImage, error) {
+	client, err := getRegistryClient()
+	if err != nil {
+		return registryImage{}, err
+	}
+
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", getRegistryScheme(), registry, repository, tag)
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return registryImage{}, errors.Wrapf(err, "invalid url %s", manifestURL)
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return registryImage{}, errors.Wrapf(err, "GET %s", manifestURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return registryImage{}, errors.Errorf("GET %s: %s", manifestURL, resp.Status)
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return registryImage{}, errors.Wrapf(err, "error parsing the response from %s", manifestURL)
+	}
+	img := registryImage{tag: tag, digest: resp.Header.Get("Docker-Content-Digest")}
+
+	// Images without a config, such as multi-arch indexes, are treated as the oldest
+	if manifest.Config.Digest == "" {
+		return img, nil
+	}
+
+	configURL := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", getRegistryScheme(), registry, repository, manifest.Config.Digest)
+	configResp, err := client.Get(configURL)
+	if err != nil {
+		return registryImage{}, errors.Wrapf(err, "GET %s", configURL)
+	}
+	defer configResp.Body.Close()
+
+	if configResp.StatusCode > 299 {
+		return registryImage{}, errors.Errorf("GET %s: %s", configURL, configResp.Status)
+	}
+
+	var config struct {
+		Created time.Time `json:"created"`
+	}
+	err = json.NewDecoder(configResp.Body).Decode(&config)
+	img.created = config.Created
+	return img, errors.Wrapf(err, "error parsing the response from %s", configURL)
+}
+
+// deleteRegistryManifest deletes a manifest, and every tag that references it, from a registry.
+func deleteRegistryManifest(registry string, repository string, digest string) error {
+	client, err := getRegistryClient()
+	if err != nil {
+		return err
+	}
+
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", getRegistryScheme(), registry, repository, digest)
+	req, err := http.NewRequest(http.MethodDelete, manifestURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "invalid url %s", manifestURL)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "DELETE %s", manifestURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		return errors.New("the local registry does not allow deleting images, recreate it with `mage StopDockerRegistry StartDockerRegistry`")
+	}
+	if resp.StatusCode > 299 {
+		return errors.Errorf("DELETE %s: %s", manifestURL, resp.Status)
+	}
+	return nil
+}
+
+// getRegistryRepositories lists the repositories in a registry that is
+// accessible over plain http, for example localhost:5000.
+func getRegistryRepositories(registry string) ([]string, error) {
+	client, err := getRegistryClient()
+	if err != nil {
+		return nil, err
+	}
+
+	catalogURL := fmt.Sprintf("%s://%s/v2/_catalog", getRegistryScheme(), registry)
+	resp, err := client.Get(catalogURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s", catalogURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return nil, errors.Errorf("GET %s: %s", catalogURL, resp.Status)
+	}
+
+	var result struct {
+		Repositories []string `json:"repositories"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Repositories, errors.Wrapf(err, "error parsing the response from %s", catalogURL)
+}
+
+func isContainerRunning(name string) bool {
+	out, _ := shx.OutputS("docker", "container", "inspect", "-f", "{{.State.Running}}", name)
+	running, _ := strconv.ParseBool(out)
+	return running
+}
+
+func containerExists(name string) bool {
+	err := shx.RunS("docker", "inspect", name)
+	return err == nil
 }
 
 func removeContainer(name string) {
@@ -334,6 +4789,763 @@ func removeContainer(name string) {
 	}
 }
 
+// Print a summary of the cluster, kubeconfig, namespace, registry and flux in use.
+func ClusterInfo() {
+	fmt.Printf("Kind cluster:   %s", getClusterName())
+	if _, ok := getClusterConfig(); !ok {
+		fmt.Printf(" (does not exist, create it with `mage EnsureCluster`)")
+	}
+	fmt.Println()
+
+	clusterKubeconfig := filepath.Join(pwd(), getKubeconfig())
+	fmt.Printf("KUBECONFIG:     %s", clusterKubeconfig)
+	if userKubeconfig, _ := filepath.Abs(os.Getenv("KUBECONFIG")); userKubeconfig != clusterKubeconfig {
+		fmt.Printf(" (your KUBECONFIG is %q)", os.Getenv("KUBECONFIG"))
+	}
+	fmt.Println()
+
+	// Read the context from the project kubeconfig, without modifying it
+	infoKubectl := func(args ...string) string {
+		if _, err := os.Stat(clusterKubeconfig); err != nil {
+			return "unknown"
+		}
+		out, err := shx.Command("kubectl", args...).Env("KUBECONFIG=" + clusterKubeconfig).OutputS()
+		if err != nil || out == "" {
+			return "unknown"
+		}
+		return out
+	}
+	fmt.Printf("Context:        %s\n", infoKubectl("config", "current-context"))
+	fmt.Printf("Namespace:      %s\n", infoKubectl("config", "view", "--minify", "-o", "jsonpath={..namespace}"))
+
+	if isContainerRunning(registryContainer) {
+		address, _ := shx.OutputS("docker", "port", registryContainer, "5000")
+		fmt.Printf("Registry:       running at %s, images are tagged localhost:%s\n", address, getRegistryPort())
+	} else {
+		fmt.Printf("Registry:       not running, start it with `mage StartDockerRegistry`\n")
+	}
+
+	fluxCLI, err := shx.OutputS("flux", "--version")
+	if err != nil {
+		fluxCLI = "not installed"
+	}
+	fmt.Printf("Flux CLI:       %s\n", fluxCLI)
+	fluxInstalled := infoKubectl("get", "namespace", fluxNamespace, "--request-timeout=5s",
+		"-o", `jsonpath={.metadata.labels.app\.kubernetes\.io/version}`)
+	fmt.Printf("Flux installed: %s (expected %s)\n", fluxInstalled, getFluxVersion())
+}
+
+// Print the installed and pinned versions of the development tools, to include in bug reports.
+func ToolVersions() {
+	kubectlPinned := getEnvOrDefault("PORTER_KUBECTL_VERSION", kubectlVersion)
+	tools := []toolVersion{
+		{name: "kind", pinned: getKindVersion(), versionArgs: []string{"version"}},
+		{name: "kubectl", pinned: kubectlPinned, versionArgs: []string{"version", "--client"}},
+		{name: "flux", pinned: getFluxVersion(), versionArgs: []string{"--version"}},
+		{name: "kustomize", pinned: kustomizeVersion, versionArgs: []string{"version"}},
+		{name: "operator-sdk", pinned: operatorSDKVersion, versionArgs: []string{"version"}},
+		{name: "controller-gen", pinned: controllerGenVersion, versionArgs: []string{"--version"}},
+		{name: "helm", pinned: helmVersion, versionArgs: []string{"version", "--short"}},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TOOL\tPINNED\tINSTALLED\tPATH\tSTATUS")
+	for _, tool := range tools {
+		toolPath, installed, status := tool.check()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", tool.name, tool.pinned, installed, toolPath, status)
+	}
+	w.Flush()
+}
+
+// toolVersion is a development tool reported by the ToolVersions target.
+type toolVersion struct {
+	name        string
+	pinned      string
+	versionArgs []string
+}
+
+// versionPattern matches the first version number in the output of a
+// version command, for example v0.10.0 in "kind v0.10.0 go1.15.7 linux/amd64".
+var versionPattern = regexp.MustCompile(`v?\d+\.\d+\.\d+`)
+
+// check finds the tool on the PATH, or in GOPATH/bin, and returns its path,
+// its version, and a status comparing the version to the pinned version.
+func (t toolVersion) check() (path string, installed string, status string) {
+	toolPath, err := exec.LookPath(t.name)
+	if err != nil {
+		toolPath = filepath.Join(pkg.GetGopathBin(), t.name+xplat.FileExt())
+		if _, err := os.Stat(toolPath); err != nil {
+			return "-", "-", "MISSING"
+		}
+	}
+
+	out, err := shx.Command(toolPath, t.versionArgs...).OutputE()
+	installed = versionPattern.FindString(out)
+	if err != nil || installed == "" {
+		return toolPath, "unknown", "UNKNOWN VERSION"
+	}
+
+	// kubectl may be pinned to the latest release, which isn't looked up here
+	if t.pinned == "stable" {
+		return toolPath, installed, "ok"
+	}
+	if strings.TrimPrefix(installed, "v") != strings.TrimPrefix(t.pinned, "v") {
+		return toolPath, installed, "MISMATCH"
+	}
+	return toolPath, installed, "ok"
+}
+
+// Check the development environment for common setup problems.
+func Doctor() {
+	// Use a throwaway copy of the cluster's kubeconfig so that checking the
+	// cluster doesn't modify the environment
+	doctorKubeconfig := ""
+	if contents, ok := getClusterConfig(); ok {
+		f, err := ioutil.TempFile("", "porter-doctor-kubeconfig")
+		mgx.Must(errors.Wrap(err, "could not create a temporary kubeconfig"))
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(contents)
+		f.Close()
+		mgx.Must(errors.Wrapf(err, "error writing %s", f.Name()))
+		doctorKubeconfig = f.Name()
+	}
+
+	clusterKubectl := func(args ...string) (string, error) {
+		if doctorKubeconfig == "" {
+			return "", errors.Errorf("the %s kind cluster does not exist", getClusterName())
+		}
+		return shx.Command("kubectl", args...).Env("KUBECONFIG=" + doctorKubeconfig).OutputS()
+	}
+
+	kindNetwork, err := getKindNetwork()
+	if err != nil {
+		kindNetwork = defaultKindNetwork
+	}
+
+	// The stable kubectl version is looked up online, so a failed lookup is
+	// reported by the check instead of stopping the doctor
+	wantKubectl, kubectlVersionErr := getKubectlVersion()
+	if kubectlVersionErr != nil {
+		wantKubectl = os.Getenv("PORTER_KUBECTL_VERSION")
+	}
+	// The flux release tag has a v prefix but flux --version does not
+	wantFlux := strings.TrimPrefix(getFluxVersion(), "v")
+
+	checks := []doctorCheck{
+		{
+			name: "docker daemon is running",
+			hint: "Start Docker and verify that `docker info` succeeds",
+			check: func() error {
+				return shx.RunS("docker", "info")
+			},
+		},
+		{
+			name:  fmt.Sprintf("kind %s is installed", getKindVersion()),
+			hint:  fmt.Sprintf("Run `mage EnsureKind`. If a different version of kind is already on your PATH, remove it or install %s manually", getKindVersion()),
+			check: checkCommandVersion("kind", getKindVersion(), "version"),
+		},
+		{
+			name: fmt.Sprintf("kubectl %s is installed", wantKubectl),
+			hint: "Run `mage EnsureKubectl`",
+			check: func() error {
+				if kubectlVersionErr != nil {
+					return kubectlVersionErr
+				}
+				return checkCommandVersion("kubectl", wantKubectl, "version", "--client")()
+			},
+		},
+		{
+			name:  fmt.Sprintf("flux %s is installed", getFluxVersion()),
+			hint:  "Run `mage EnsureFlux`",
+			check: checkCommandVersion("flux", wantFlux, "--version"),
+		},
+		{
+			name:  fmt.Sprintf("controller-gen %s is installed", controllerGenVersion),
+			hint:  "Run `mage EnsureControllerGen`",
+			check: checkCommandVersion("controller-gen", controllerGenVersion, "--version"),
+		},
+		{
+			name:  fmt.Sprintf("operator-sdk %s is installed", operatorSDKVersion),
+			hint:  "Run `mage EnsureOperatorSDK`",
+			check: checkCommandVersion("operator-sdk", operatorSDKVersion, "version"),
+		},
+		{
+			name: fmt.Sprintf("kind cluster %s exists and is reachable", getClusterName()),
+			hint: "Run `mage EnsureCluster`. If the cluster exists but is unreachable, recreate it with `mage DeleteKindCluster EnsureCluster`",
+			check: func() error {
+				_, err := clusterKubectl("get", "namespaces", "--request-timeout=5s")
+				return err
+			},
+		},
+		{
+			name: "local docker registry is running",
+			hint: "Run `mage StartDockerRegistry`",
+			check: func() error {
+				if !isContainerRunning(registryContainer) {
+					return errors.Errorf("the %s container is not running", registryContainer)
+				}
+				return nil
+			},
+		},
+		{
+			name: "local docker registry is connected to the kind network",
+			hint: fmt.Sprintf("Run `docker network connect %s %s`", kindNetwork, registryContainer),
+			check: func() error {
+				if !isOnDockerNetwork(registryContainer, kindNetwork) {
+					return errors.Errorf("the %s container is not on the %s network", registryContainer, kindNetwork)
+				}
+				return nil
+			},
+		},
+		{
+			name: "flux controllers are ready",
+			hint: "Run `mage EnsureCluster` to reinstall flux, or inspect the controllers with `kubectl get pods -n " + fluxNamespace + "`",
+			check: func() error {
+				out, err := clusterKubectl("get", "deployments", "-n", fluxNamespace, "-o", `jsonpath={range .items[*]}{.metadata.name} {.status.readyReplicas} {.spec.replicas}{"\n"}{end}`)
+				if err != nil {
+					return err
+				}
+				if strings.TrimSpace(out) == "" {
+					return errors.Errorf("no flux controllers found in the %s namespace", fluxNamespace)
+				}
+				return checkDeploymentsReady(out)
+			},
+		},
+		{
+			name: "porter operator is ready",
+			hint: fmt.Sprintf("Inspect the operator with `kubectl describe deployment %s -n %s`", operatorDeployment, getOperatorNamespace()),
+			check: func() error {
+				out, err := clusterKubectl("get", "deployment", operatorDeployment, "-n", getOperatorNamespace(), "-o", `jsonpath={.metadata.name} {.status.readyReplicas} {.spec.replicas}`)
+				if err != nil {
+					return errors.Errorf("the %s deployment was not found in the %s namespace", operatorDeployment, getOperatorNamespace())
+				}
+				return checkDeploymentsReady(out)
+			},
+		},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed++
+			fmt.Printf("✗ %s\n", c.name)
+			fmt.Printf("    %s\n", err)
+			fmt.Printf("    Hint: %s\n", c.hint)
+		} else {
+			fmt.Printf("✓ %s\n", c.name)
+		}
+	}
+
+	if failed > 0 {
+		mgx.Must(errors.Errorf("%d of %d checks failed", failed, len(checks)))
+	}
+}
+
+// doctorCheck is a single diagnostic performed by the Doctor target.
+type doctorCheck struct {
+	name  string
+	hint  string
+	check func() error
+}
+
+// checkCommandVersion returns a doctor check that verifies a command is on the PATH,
+// optionally at a specific version.
+func checkCommandVersion(cmd string, version string, versionArgs ...string) func() error {
+	return func() error {
+		found, err := pkg.IsCommandAvailable(cmd, version, versionArgs...)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if version == "" {
+				return errors.Errorf("%s was not found on the PATH", cmd)
+			}
+			return errors.Errorf("%s %s was not found on the PATH", cmd, version)
+		}
+		return nil
+	}
+}
+
+// checkDeploymentsReady parses lines of "NAME READY DESIRED" and returns an
+// error listing any deployments that don't have all of their replicas ready.
+func checkDeploymentsReady(status string) error {
+	var notReady []string
+	for _, line := range strings.Split(strings.TrimSpace(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// readyReplicas is omitted entirely when no replicas are ready
+		ready, desired := "0", "1"
+		if len(fields) == 2 {
+			desired = fields[1]
+		} else if len(fields) >= 3 {
+			ready, desired = fields[1], fields[2]
+		}
+		if ready != desired {
+			notReady = append(notReady, fmt.Sprintf("%s (%s/%s ready)", fields[0], ready, desired))
+		}
+	}
+	if len(notReady) > 0 {
+		return errors.Errorf("not ready: %s", strings.Join(notReady, ", "))
+	}
+	return nil
+}
+
+// Report the size of each layer in the operator image, warning about large layers.
+func AnalyzeImage() {
+	img := os.Getenv("PORTER_IMAGE")
+	if img == "" {
+		img = getOperatorImage()
+	}
+
+	thresholdMB := defaultLayerWarningMB
+	if value := os.Getenv("PORTER_LAYER_WARN_MB"); value != "" {
+		var err error
+		thresholdMB, err = strconv.Atoi(value)
+		mgx.Must(errors.Wrapf(err, "invalid PORTER_LAYER_WARN_MB %q", value))
+	}
+	threshold := int64(thresholdMB) * 1024 * 1024
+
+	layers, err := getImageLayers(img)
+	mgx.Must(errors.Wrapf(err, "could not inspect the layers of %s, has it been built?", img))
+
+	// The final stage's base image layers are at the bottom of the history
+	// and aren't something we can shrink, so don't warn about them
+	baseImage := getDockerfileBaseImage("Dockerfile")
+	if baseImage != "" {
+		baseLayers, err := getImageLayers(baseImage)
+		if err != nil {
+			fmt.Printf("Could not inspect the base image %s, all layers will be checked against the threshold\n", baseImage)
+		} else {
+			start := len(layers) - len(baseLayers)
+			if start < 0 {
+				start = 0
+			}
+			for i := start; i < len(layers); i++ {
+				layers[i].base = true
+			}
+		}
+	}
+
+	var total int64
+	for _, l := range layers {
+		total += l.size
+	}
+
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].size > layers[j].size
+	})
+
+	fmt.Printf("Layers in %s (total %s)\n", img, formatBytes(total))
+	var warnings int
+	for _, l := range layers {
+		if l.size == 0 {
+			continue
+		}
+		marker := "  "
+		if l.base {
+			marker = "B "
+		} else if l.size > threshold {
+			marker = "! "
+			warnings++
+		}
+		fmt.Printf("%s%10s  %s\n", marker, formatBytes(l.size), l.createdBy)
+	}
+
+	if warnings > 0 {
+		fmt.Printf("\nWARNING: %d layer(s) exceed %dMB. Check that large files aren't accidentally copied into the image.\n", warnings, thresholdMB)
+	}
+}
+
+// imageLayer is a single layer from the history of a docker image.
+type imageLayer struct {
+	size      int64
+	createdBy string
+	base      bool
+}
+
+// getImageLayers returns the layers of an image, newest first.
+func getImageLayers(img string) ([]imageLayer, error) {
+	out, err := shx.OutputE("docker", "history", "--no-trunc", "--human=false", "--format", "{{.Size}}\t{{.CreatedBy}}", img)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []imageLayer
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid layer size %q", parts[0])
+		}
+
+		createdBy := strings.TrimPrefix(parts[1], "/bin/sh -c #(nop) ")
+		createdBy = strings.TrimSpace(strings.TrimPrefix(createdBy, "/bin/sh -c "))
+		if len(createdBy) > 80 {
+			createdBy = createdBy[:77] + "..."
+		}
+		layers = append(layers, imageLayer{size: size, createdBy: createdBy})
+	}
+	return layers, nil
+}
+
+// getDockerfileBaseImage returns the base image of the final stage in a Dockerfile.
+func getDockerfileBaseImage(dockerfile string) string {
+	contents, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return ""
+	}
+
+	var base string
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "FROM") {
+			base = fields[1]
+		}
+	}
+	return base
+}
+
+// formatBytes prints a byte count using the largest whole unit.
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// isCommandCurrent determines if a command is installed and is the expected
+// version, from the output of running it with versionArgs. An out-of-date
+// command is reported so that it's clear why it is being installed again.
+func isCommandCurrent(cmd string, version string, versionArgs ...string) bool {
+	if ok, _ := pkg.IsCommandAvailable(cmd, version, versionArgs...); ok {
+		return true
+	}
+	if ok, _ := pkg.IsCommandAvailable(cmd, ""); ok {
+		toolsLog.Printf("The installed %s is not %s, installing %s to $GOPATH/bin", cmd, version, version)
+	}
+	return false
+}
+
+// warnIfShadowed warns when a tool that was installed to GOPATH/bin won't be
+// used, because another copy of it is earlier in the PATH.
+func warnIfShadowed(tool string) {
+	found, err := exec.LookPath(tool)
+	if err != nil {
+		return
+	}
+	if filepath.Dir(found) != pkg.GetGopathBin() {
+		toolsLog.Printf("WARNING: %s is used instead of the %s in $GOPATH/bin, remove it or put $GOPATH/bin first in your PATH", found, tool)
+	}
+}
+
+// installFromToolsDir copies a tool from PORTER_TOOLS_DIR to GOPATH/bin, for
+// environments that can't download the tools. It returns false, without
+// doing anything, when PORTER_TOOLS_DIR isn't set, and stops the build when
+// the tool isn't in the directory rather than trying to download it.
+func installFromToolsDir(tool string) bool {
+	dir := os.Getenv("PORTER_TOOLS_DIR")
+	if dir == "" {
+		return false
+	}
+
+	src := filepath.Join(dir, tool+xplat.FileExt())
+	f, err := os.Open(src)
+	if os.IsNotExist(err) {
+		mgx.Must(errors.Errorf("air-gapped mode: %s not found in PORTER_TOOLS_DIR %s", tool, dir))
+	}
+	mgx.Must(errors.Wrapf(err, "could not open %s", src))
+	defer f.Close()
+
+	toolsLog.Printf("Installing %s from %s to $GOPATH/bin", tool, dir)
+	mgx.Must(pkg.EnsureGopathBin())
+	mgx.Must(errors.Wrapf(writeToGopathBin(tool, f, ""), "could not install %s", src))
+	return true
+}
+
+// withToolArch replaces {{.GOARCH}} in a download template with the
+// architecture of the tool's release for the current platform, or stops the
+// build when the tool doesn't publish one, see getToolArch.
+func withToolArch(tool string, srcTemplate string) string {
+	arch, err := getToolArch(tool, runtime.GOOS, runtime.GOARCH)
+	mgx.Must(err)
+	return strings.ReplaceAll(srcTemplate, "{{.GOARCH}}", arch)
+}
+
+// getToolArch returns the architecture of the tool's release to download for
+// the specified platform, which is goarch unless a fallback is used.
+func getToolArch(tool string, goos string, goarch string) (string, error) {
+	platforms, ok := toolPlatforms[tool]
+	if !ok {
+		return goarch, nil
+	}
+
+	platform := goos + "/" + goarch
+	if hasPlatform(platforms, platform) {
+		return goarch, nil
+	}
+	if fallback, ok := toolPlatformFallbacks[platform]; ok && hasPlatform(platforms, fallback) {
+		toolsLog.Debugf("%s does not publish a %s release, using %s instead", tool, platform, fallback)
+		return path.Base(fallback), nil
+	}
+
+	return "", errors.Errorf("%s does not publish a release for %s, please install it manually", tool, platform)
+}
+
+// hasPlatform determines if a platform, as GOOS/GOARCH, is in the list.
+func hasPlatform(platforms []string, platform string) bool {
+	for _, p := range platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// Download a gzipped tarball and extract a single executable from it to GOPATH/bin.
+// When checksumsTemplate is set, the tarball is only extracted when its
+// SHA256 checksum matches, see downloadAndVerify for the supported formats.
+// srcTemplate, entryTemplate, the path of the executable in the tarball, and
+// checksumsTemplate support the same template values as downloadToGopathBin.
+func downloadTarballToGopathBin(srcTemplate string, entryTemplate string, checksumsTemplate string, name string, version string) error {
+	src, err := renderDownloadTemplate(srcTemplate, version)
+	if err != nil {
+		return err
+	}
+	entry, err := renderDownloadTemplate(entryTemplate, version)
+	if err != nil {
+		return err
+	}
+	toolsLog.Printf("Downloading %s to $GOPATH/bin", src)
+
+	var checksum string
+	if checksumsTemplate != "" {
+		checksumsURL, err := renderDownloadTemplate(checksumsTemplate, version)
+		if err != nil {
+			return err
+		}
+		checksum, err = getChecksum(checksumsURL, path.Base(src))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pkg.EnsureGopathBin()
+	if err != nil {
+		return err
+	}
+
+	r, err := httpClient.Get(src)
+	if err != nil {
+		return errors.Wrapf(err, "could not resolve %s", src)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode > 299 {
+		return errors.Errorf("GET %s: %s", src, r.Status)
+	}
+
+	// The whole tarball is checked before anything is extracted from it
+	tarball, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errors.Wrapf(err, "error downloading %s", src)
+	}
+	if checksum != "" {
+		if actual := fmt.Sprintf("%x", sha256.Sum256(tarball)); actual != checksum {
+			return errors.Errorf("checksum mismatch for %s, expected %s but got %s", path.Base(src), checksum, actual)
+		}
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return errors.Wrapf(err, "%s is not a gzipped file", src)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.Errorf("%s was not found in %s", entry, src)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s", src)
+		}
+
+		if path.Clean(hdr.Name) != path.Clean(entry) || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		return errors.Wrapf(writeToGopathBin(name, tr, ""), "error extracting %s from %s", entry, src)
+	}
+}
+
+// Download an executable to GOPATH/bin, after verifying its SHA256 checksum.
+// The checksums file may either contain only the checksum of the download,
+// or lines of CHECKSUM FILENAME, like the output of sha256sum. Both
+// srcTemplate and checksumsTemplate support the same template values as
+// downloadToGopathBin.
+func downloadAndVerify(srcTemplate string, checksumsTemplate string, name string, version string) error {
+	src, err := renderDownloadTemplate(srcTemplate, version)
+	if err != nil {
+		return err
+	}
+	checksumsURL, err := renderDownloadTemplate(checksumsTemplate, version)
+	if err != nil {
+		return err
+	}
+	toolsLog.Printf("Downloading %s to $GOPATH/bin", src)
+
+	checksum, err := getChecksum(checksumsURL, path.Base(src))
+	if err != nil {
+		return err
+	}
+
+	err = pkg.EnsureGopathBin()
+	if err != nil {
+		return err
+	}
+	return downloadExecutable(src, filepath.Join(pkg.GetGopathBin(), name+xplat.FileExt()), checksum)
+}
+
+// Download an executable to GOPATH/bin. This is the same as
+// pkg.DownloadToGopathBin, except that it uses httpClient so that the
+// proxy settings are respected, and it checks the response status.
+func downloadToGopathBin(srcTemplate string, name string, version string) error {
+	src, err := renderDownloadTemplate(srcTemplate, version)
+	if err != nil {
+		return err
+	}
+	toolsLog.Printf("Downloading %s to $GOPATH/bin", src)
+
+	err = pkg.EnsureGopathBin()
+	if err != nil {
+		return err
+	}
+	return downloadExecutable(src, filepath.Join(pkg.GetGopathBin(), name+xplat.FileExt()), "")
+}
+
+// downloadExecutable saves the executable at a url to dest, verifying its
+// SHA256 checksum when one is specified.
+func downloadExecutable(src string, dest string, checksum string) error {
+	r, err := httpClient.Get(src)
+	if err != nil {
+		return errors.Wrapf(err, "could not resolve %s", src)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode > 299 {
+		return errors.Errorf("GET %s: %s", src, r.Status)
+	}
+
+	return errors.Wrapf(writeExecutable(dest, r.Body, checksum), "error downloading %s", src)
+}
+
+// getChecksum finds the checksum of a file in a checksums file.
+func getChecksum(checksumsURL string, file string) (string, error) {
+	r, err := httpClient.Get(checksumsURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve %s", checksumsURL)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode > 299 {
+		return "", errors.Errorf("GET %s: %s", checksumsURL, r.Status)
+	}
+
+	contents, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading %s", checksumsURL)
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			return strings.ToLower(fields[0]), nil
+		}
+		// sha256sum prefixes the file name with * in binary mode
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == file {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", errors.Errorf("the checksum of %s was not found in %s", file, checksumsURL)
+}
+
+// writeToGopathBin saves an executable to GOPATH/bin. When checksum is set,
+// the executable is only saved when its SHA256 checksum matches.
+func writeToGopathBin(name string, contents io.Reader, checksum string) error {
+	return writeExecutable(filepath.Join(pkg.GetGopathBin(), name+xplat.FileExt()), contents, checksum)
+}
+
+// writeExecutable saves an executable to dest. When checksum is set, the
+// executable is only saved when its SHA256 checksum matches.
+func writeExecutable(dest string, contents io.Reader, checksum string) error {
+	name := filepath.Base(dest)
+
+	// Write to a temp file in the same directory, so the final rename isn't across devices
+	f, err := ioutil.TempFile(filepath.Dir(dest), name)
+	if err != nil {
+		return errors.Wrap(err, "could not create temp file")
+	}
+	defer os.Remove(f.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), contents)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if checksum != "" {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+			return errors.Errorf("checksum mismatch for %s, expected %s but got %s", name, checksum, actual)
+		}
+	}
+
+	err = os.Chmod(f.Name(), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "could not make %s executable", f.Name())
+	}
+
+	err = os.Rename(f.Name(), dest)
+	return errors.Wrapf(err, "error moving %s to %s", name, dest)
+}
+
+// renderDownloadTemplate populates a download url template, supporting the
+// same template values as downloadToGopathBin.
+func renderDownloadTemplate(srcTemplate string, version string) (string, error) {
+	tmpl, err := template.New("url").Parse(srcTemplate)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing %s as a Go template", srcTemplate)
+	}
+
+	srcData := struct {
+		GOOS    string
+		GOARCH  string
+		EXT     string
+		VERSION string
+	}{
+		GOOS:    runtime.GOOS,
+		GOARCH:  runtime.GOARCH,
+		EXT:     xplat.FileExt(),
+		VERSION: version,
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, srcData)
+	return buf.String(), errors.Wrapf(err, "error rendering %s as a Go template", srcTemplate)
+}
+
 func pwd() string {
 	wd, _ := os.Getwd()
 	return wd
@@ -0,0 +1,408 @@
+//go:build mage
+// +build mage
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/carolynvs/magex/pkg"
+	"sigs.k8s.io/yaml"
+)
+
+// renderedKindConfig is the subset of the kind cluster configuration that is
+// checked by the tests.
+type renderedKindConfig struct {
+	Networking *struct {
+		DisableDefaultCNI bool   `json:"disableDefaultCNI"`
+		PodSubnet         string `json:"podSubnet"`
+	} `json:"networking"`
+	Nodes []struct {
+		Role                 string      `json:"role"`
+		ExtraMounts          []kindMount `json:"extraMounts"`
+		KubeadmConfigPatches []string    `json:"kubeadmConfigPatches"`
+	} `json:"nodes"`
+	ContainerdConfigPatches []string `json:"containerdConfigPatches"`
+}
+
+func renderTestKindConfig(t *testing.T, data kindConfig) renderedKindConfig {
+	t.Helper()
+
+	contents, err := renderKindConfig("hack/kind.config.yaml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg renderedKindConfig
+	if err := yaml.Unmarshal(contents, &cfg); err != nil {
+		t.Fatalf("the rendered kind config is not valid yaml: %s\n%s", err, contents)
+	}
+	return cfg
+}
+
+func TestRenderKindConfig_Defaults(t *testing.T) {
+	cfg := renderTestKindConfig(t, kindConfig{RegistryPort: "5000"})
+
+	if cfg.Networking != nil {
+		t.Errorf("expected the default networking, got %+v", *cfg.Networking)
+	}
+	if len(cfg.Nodes) != 0 {
+		t.Errorf("expected the default nodes, got %d nodes", len(cfg.Nodes))
+	}
+	if len(cfg.ContainerdConfigPatches) != 1 {
+		t.Fatalf("expected 1 containerd config patch, got %d", len(cfg.ContainerdConfigPatches))
+	}
+	patch := cfg.ContainerdConfigPatches[0]
+	if !strings.Contains(patch, `registry.mirrors."localhost:5000"`) || !strings.Contains(patch, `endpoint = ["http://registry:5000"]`) {
+		t.Errorf("expected the local registry mirror over http, got\n%s", patch)
+	}
+}
+
+func TestRenderKindConfig_AllOptions(t *testing.T) {
+	mount := kindMount{HostPath: "/tmp/bundles", ContainerPath: "/bundles", ReadOnly: true}
+	auditMount := kindMount{HostPath: "/tmp/audit", ContainerPath: "/var/log/kubernetes"}
+	cfg := renderTestKindConfig(t, kindConfig{
+		RegistryPort:       "5001",
+		RegistryCA:         "/etc/porter/registry-certs/ca.crt",
+		RegistryMirror:     "http://mirror:5000",
+		Workers:            make([]int, 2),
+		Mounts:             []kindMount{mount},
+		ControlPlaneMounts: []kindMount{mount, auditMount},
+		Audit: &kindAudit{
+			PolicyPath: "/etc/kubernetes/audit-policy.yaml",
+			LogDir:     "/var/log/kubernetes",
+			LogPath:    "/var/log/kubernetes/audit.log",
+		},
+		KubeletArgs:       map[string]string{"system-reserved": "memory=512Mi"},
+		DisableDefaultCNI: true,
+		PodSubnet:         calicoPodSubnet,
+	})
+
+	if cfg.Networking == nil || !cfg.Networking.DisableDefaultCNI || cfg.Networking.PodSubnet != calicoPodSubnet {
+		t.Errorf("expected the default CNI to be disabled with the pod subnet %s, got %+v", calicoPodSubnet, cfg.Networking)
+	}
+
+	if len(cfg.Nodes) != 3 {
+		t.Fatalf("expected a control plane and 2 workers, got %d nodes", len(cfg.Nodes))
+	}
+	controlPlane := cfg.Nodes[0]
+	if controlPlane.Role != "control-plane" {
+		t.Errorf("expected the first node to be the control plane, got %s", controlPlane.Role)
+	}
+	if len(controlPlane.ExtraMounts) != 2 || controlPlane.ExtraMounts[1].ContainerPath != auditMount.ContainerPath {
+		t.Errorf("expected the control plane to have the mount and the audit logs mount, got %+v", controlPlane.ExtraMounts)
+	}
+	patches := strings.Join(controlPlane.KubeadmConfigPatches, "\n")
+	for _, want := range []string{
+		`audit-log-path: "/var/log/kubernetes/audit.log"`,
+		`audit-policy-file: "/etc/kubernetes/audit-policy.yaml"`,
+		"kind: InitConfiguration",
+		`system-reserved: "memory=512Mi"`,
+	} {
+		if !strings.Contains(patches, want) {
+			t.Errorf("expected the control plane patches to contain %q, got\n%s", want, patches)
+		}
+	}
+
+	for _, worker := range cfg.Nodes[1:] {
+		if worker.Role != "worker" {
+			t.Errorf("expected a worker node, got %s", worker.Role)
+		}
+		if len(worker.ExtraMounts) != 1 || worker.ExtraMounts[0] != mount {
+			t.Errorf("expected the worker to have the mount %+v, got %+v", mount, worker.ExtraMounts)
+		}
+		if len(worker.KubeadmConfigPatches) != 1 || !strings.Contains(worker.KubeadmConfigPatches[0], "kind: JoinConfiguration") {
+			t.Errorf("expected the worker to have the kubelet args in a JoinConfiguration, got %v", worker.KubeadmConfigPatches)
+		}
+	}
+
+	if len(cfg.ContainerdConfigPatches) != 1 {
+		t.Fatalf("expected 1 containerd config patch, got %d", len(cfg.ContainerdConfigPatches))
+	}
+	patch := cfg.ContainerdConfigPatches[0]
+	for _, want := range []string{
+		`registry.mirrors."localhost:5001"`,
+		`endpoint = ["https://registry:5000"]`,
+		`ca_file = "/etc/porter/registry-certs/ca.crt"`,
+		`endpoint = ["http://mirror:5000", "https://registry-1.docker.io"]`,
+	} {
+		if !strings.Contains(patch, want) {
+			t.Errorf("expected the containerd config patch to contain %q, got\n%s", want, patch)
+		}
+	}
+}
+
+// setenv sets an environment variable for the duration of a test.
+func setenv(t *testing.T, key string, value string) {
+	t.Helper()
+
+	original, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, original)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestAddGopathBinOnGithubActions(t *testing.T) {
+	githubPath := filepath.Join(t.TempDir(), "github_path")
+	if err := ioutil.WriteFile(githubPath, []byte("/opt/existing/bin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "GITHUB_PATH", githubPath)
+	addGopathBinOnce = sync.Once{}
+
+	for i := 0; i < 2; i++ {
+		if err := addGopathBinOnGithubActions(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(githubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/opt/existing/bin\n" + pkg.GetGopathBin() + "\n"
+	if string(contents) != want {
+		t.Errorf("expected GOPATH/bin to be appended once to GITHUB_PATH, got\n%s", contents)
+	}
+}
+
+func TestGetStableKubectlVersion(t *testing.T) {
+	testcases := []struct {
+		name      string
+		status    int
+		body      string
+		want      string
+		wantError string
+	}{
+		{name: "ok", status: http.StatusOK, body: "v1.20.2\n", want: "v1.20.2"},
+		{name: "not found", status: http.StatusNotFound, body: "not found", wantError: ": 404 Not Found"},
+		{name: "empty body", status: http.StatusOK, body: "", wantError: "the response did not have a version"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			got, err := getStableKubectlVersion(server.URL + "/stable.txt")
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantError, err)
+				}
+				if strings.Contains(err.Error(), "%!") {
+					t.Errorf("the error was formatted incorrectly: %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetToolArch(t *testing.T) {
+	testcases := []struct {
+		tool, goos, goarch string
+		want               string
+		wantError          bool
+	}{
+		{tool: "kind", goos: "linux", goarch: "amd64", want: "amd64"},
+		{tool: "kind", goos: "linux", goarch: "arm64", want: "arm64"},
+		{tool: "kubectl", goos: "linux", goarch: "arm", want: "arm"},
+		{tool: "flux", goos: "linux", goarch: "arm", want: "arm"},
+		{tool: "kubectl", goos: "darwin", goarch: "arm64", want: "arm64"},
+		// kind doesn't publish darwin/arm64, so the amd64 release runs with Rosetta
+		{tool: "kind", goos: "darwin", goarch: "arm64", want: "amd64"},
+		{tool: "kind", goos: "linux", goarch: "arm", wantError: true},
+		{tool: "porter", goos: "windows", goarch: "arm64", wantError: true},
+		// Tools without a mapping use the go architecture
+		{tool: "unmapped", goos: "linux", goarch: "arm", want: "arm"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(fmt.Sprintf("%s %s/%s", tc.tool, tc.goos, tc.goarch), func(t *testing.T) {
+			got, err := getToolArch(tc.tool, tc.goos, tc.goarch)
+			if tc.wantError {
+				if err == nil {
+					t.Fatalf("expected an unsupported platform error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDownloadToGopathBin_UsesProxy(t *testing.T) {
+	// The proxy environment variables are only read once per process, so the
+	// download is run in a copy of the test binary with HTTPS_PROXY set
+	if os.Getenv("PORTER_TEST_PROXY_DOWNLOAD") == "true" {
+		downloadToGopathBin("https://tools.example.com/{{.VERSION}}/kind", "kind", "v0.10.0")
+		return
+	}
+
+	var mu sync.Mutex
+	var requests []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.Host)
+		http.Error(w, "stub proxy", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDownloadToGopathBin_UsesProxy$")
+	cmd.Env = append(os.Environ(),
+		"PORTER_TEST_PROXY_DOWNLOAD=true",
+		"GOPATH="+t.TempDir(),
+		"HTTPS_PROXY="+proxy.URL, "https_proxy="+proxy.URL,
+		"NO_PROXY=", "no_proxy=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("the download failed to run: %s\n%s", err, out)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 || requests[0] != "CONNECT tools.example.com:443" {
+		t.Errorf("expected the download to go through the proxy, got requests %v", requests)
+	}
+}
+
+func TestParseMetrics(t *testing.T) {
+	samples := parseMetrics(`# HELP controller_runtime_reconcile_total Total number of reconciliations per controller
+# TYPE controller_runtime_reconcile_total counter
+controller_runtime_reconcile_total{controller="gitrepository",result="success"} 12
+controller_runtime_reconcile_total{controller="gitrepository",result="error"} 3
+controller_runtime_reconcile_total{controller="installation",result="success"} 5
+process_resident_memory_bytes 4.2e+07
+not a sample
+`)
+
+	if len(samples) != 4 {
+		t.Fatalf("expected 4 samples, got %d: %+v", len(samples), samples)
+	}
+	if got := samples[1].labels["result"]; got != "error" {
+		t.Errorf("expected the result label to be parsed, got %q", got)
+	}
+	if got := samples.sum("controller_runtime_reconcile_total"); got != 20 {
+		t.Errorf("expected the reconciles to sum across labels to 20, got %v", got)
+	}
+	if got := samples.sum("process_resident_memory_bytes"); got != 42000000 {
+		t.Errorf("expected the memory sample without labels, got %v", got)
+	}
+	if got := samples.sum("missing"); got != 0 {
+		t.Errorf("expected a missing metric to sum to 0, got %v", got)
+	}
+}
+
+func TestDownloadTarballToGopathBin_VerifiesChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	contents := []byte("#!/bin/sh\necho flux\n")
+	tw.WriteHeader(&tar.Header{Name: "flux", Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+	tw.Write(contents)
+	tw.Close()
+	gzw.Close()
+	tarball := buf.Bytes()
+
+	testcases := []struct {
+		name      string
+		checksums string
+		wantError string
+	}{
+		{name: "match", checksums: fmt.Sprintf("%x  flux.tar.gz\n", sha256.Sum256(tarball))},
+		{name: "mismatch", checksums: fmt.Sprintf("%x  flux.tar.gz\n", sha256.Sum256([]byte("tampered"))), wantError: "checksum mismatch for flux.tar.gz"},
+		{name: "missing", checksums: fmt.Sprintf("%x  other.tar.gz\n", sha256.Sum256(tarball)), wantError: "the checksum of flux.tar.gz was not found"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/flux.tar.gz":
+					w.Write(tarball)
+				case "/checksums.txt":
+					fmt.Fprint(w, tc.checksums)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			gopath := t.TempDir()
+			setenv(t, "GOPATH", gopath)
+			setenv(t, "PATH", os.Getenv("PATH"))
+
+			err := downloadTarballToGopathBin(server.URL+"/flux.tar.gz", "flux", server.URL+"/checksums.txt", "flux", "v0.7.0")
+			dest := filepath.Join(gopath, "bin", "flux")
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantError, err)
+				}
+				if _, err := os.Stat(dest); !os.IsNotExist(err) {
+					t.Errorf("expected flux not to be extracted when the checksum isn't verified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("expected flux to be extracted, got\n%s", got)
+			}
+		})
+	}
+}
+
+func TestSaveEnv(t *testing.T) {
+	setenv(t, "PORTER_KIND_CLUSTER", "porter")
+	restore := saveEnv("PORTER_KIND_CLUSTER")
+	os.Setenv("PORTER_KIND_CLUSTER", "porter-e2e")
+	restore()
+	if got := os.Getenv("PORTER_KIND_CLUSTER"); got != "porter" {
+		t.Errorf("expected PORTER_KIND_CLUSTER to be restored to porter, got %q", got)
+	}
+
+	os.Unsetenv("PORTER_KIND_CLUSTER")
+	restore = saveEnv("PORTER_KIND_CLUSTER")
+	os.Setenv("PORTER_KIND_CLUSTER", "porter-e2e")
+	restore()
+	if got, ok := os.LookupEnv("PORTER_KIND_CLUSTER"); ok {
+		t.Errorf("expected PORTER_KIND_CLUSTER to be unset again, got %q", got)
+	}
+}